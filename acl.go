@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var errOnionBlocked = errors.New("access to this onion service is blocked on this proxy")
+
+// onionList is a list of onion services loaded from a file. Every line
+// contains one entry, empty lines and lines starting with # are ignored:
+//
+//	# only the service itself
+//	duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion
+//	# only this subdomain
+//	api.duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion
+//	# the service and all of its subdomains
+//	*.duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion
+type onionList struct {
+	exact    map[string]bool
+	wildcard map[string]bool
+}
+
+func loadOnionList(path string) (*onionList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %w", path, err)
+	}
+	defer f.Close()
+	list, err := parseOnionList(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return list, nil
+}
+
+func parseOnionList(r io.Reader) (*onionList, error) {
+	l := &onionList{
+		exact:    make(map[string]bool),
+		wildcard: make(map[string]bool),
+	}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		wildcard := strings.HasPrefix(line, "*.")
+		line = strings.TrimPrefix(line, "*.")
+		if !strings.HasSuffix(line, ".onion") {
+			line = fmt.Sprintf("%s.onion", line)
+		}
+		target, err := parseOnionTarget(line, "", ".onion")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if wildcard {
+			if len(target.Subdomains) > 0 {
+				return nil, fmt.Errorf("line %d: wildcards are only supported in front of the service id", lineNumber)
+			}
+			l.wildcard[target.ServiceID] = true
+			continue
+		}
+		l.exact[target.Hostname()] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *onionList) matches(target onionTarget) bool {
+	return l.wildcard[target.ServiceID] || l.exact[target.Hostname()]
+}
+
+func (l *onionList) Len() int {
+	return len(l.exact) + len(l.wildcard)
+}
+
+// onionACL decides which onion services can be reached through the proxy.
+// Denied services are always blocked, if an allowlist is configured only the
+// services on it can be reached.
+type onionACL struct {
+	allow *onionList
+	deny  *onionList
+}
+
+func (a *onionACL) allowed(target onionTarget) bool {
+	if a == nil {
+		return true
+	}
+	if a.deny != nil && a.deny.matches(target) {
+		return false
+	}
+	if a.allow != nil && !a.allow.matches(target) {
+		return false
+	}
+	return true
+}
+
+// loadACL (re)loads the allow and deny lists from disk. The current lists
+// stay active if one of the files can not be loaded.
+func (app *application) loadACL() error {
+	acl := &onionACL{}
+	if app.allowlistPath != "" {
+		list, err := loadOnionList(app.allowlistPath)
+		if err != nil {
+			return fmt.Errorf("could not load allowlist: %w", err)
+		}
+		acl.allow = list
+	}
+	if app.denylistPath != "" {
+		list, err := loadOnionList(app.denylistPath)
+		if err != nil {
+			return fmt.Errorf("could not load denylist: %w", err)
+		}
+		acl.deny = list
+	}
+	app.acl.Store(acl)
+	return nil
+}
+
+// blocked renders the blocked page
+func (app *application) blocked(w http.ResponseWriter, target onionTarget, statusCode int, reason error) {
+	app.logger.Infof("blocked request to %s: %v", target.Hostname(), reason)
+	if app.JsonLoggerEnabled {
+		message := fmt.Sprintf("blocked request to %s: %v", target.Hostname(), reason)
+		app.JsonLogger.DebugLevel(message)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(statusCode)
+	data := struct {
+		Host  string
+		Error string
+	}{
+		Host:  target.Hostname(),
+		Error: reason.Error(),
+	}
+	if err := app.templates.ExecuteTemplate(w, "blocked.tmpl", data); err != nil {
+		app.logger.Error(err)
+		if app.JsonLoggerEnabled {
+			app.JsonLogger.ErrorLevel(err.Error())
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOnionList(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name             string
+		input            string
+		expectedExact    []string
+		expectedWildcard []string
+		err              string
+	}{
+		{"empty", "# nothing\n\n", nil, nil, ""},
+		{"exact", testOnionID + ".onion", []string{testOnionID + ".onion"}, nil, ""},
+		{"without suffix", strings.ToUpper(testOnionID), []string{testOnionID + ".onion"}, nil, ""},
+		{"subdomain", "api." + testOnionID + ".onion", []string{"api." + testOnionID + ".onion"}, nil, ""},
+		{"wildcard", "*." + testOnionID + ".onion", nil, []string{testOnionID}, ""},
+		{"invalid", "asdf.onion", nil, nil, "line 1: invalid onion address"},
+		{"wildcard subdomain", "*.api." + testOnionID + ".onion", nil, nil, "line 1: wildcards are only supported"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			list, err := parseOnionList(strings.NewReader(tt.input))
+			if tt.err != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, len(tt.expectedExact)+len(tt.expectedWildcard), list.Len())
+			for _, host := range tt.expectedExact {
+				assert.True(t, list.exact[host])
+			}
+			for _, id := range tt.expectedWildcard {
+				assert.True(t, list.wildcard[id])
+			}
+		})
+	}
+}
+
+func TestOnionACL(t *testing.T) {
+	t.Parallel()
+
+	service := onionTarget{ServiceID: testOnionID}
+	subdomain := onionTarget{ServiceID: testOnionID, Subdomains: []string{"api"}}
+	other := onionTarget{ServiceID: testOnionIDOther}
+
+	tests := []struct {
+		name     string
+		allow    string
+		deny     string
+		target   onionTarget
+		expected bool
+	}{
+		{"no lists", "", "", service, true},
+		{"denied exact", "", testOnionID, service, false},
+		{"denied exact other subdomain", "", testOnionID, subdomain, true},
+		{"denied wildcard", "", "*." + testOnionID, subdomain, false},
+		{"denied wildcard service", "", "*." + testOnionID, service, false},
+		{"allowed", testOnionID, "", service, true},
+		{"not allowed", testOnionID, "", other, false},
+		{"allowed subdomain", "api." + testOnionID, "", subdomain, true},
+		{"allowed subdomain only", "api." + testOnionID, "", service, false},
+		{"deny wins", "*." + testOnionID, "api." + testOnionID, subdomain, false},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			acl := &onionACL{}
+			if tt.allow != "" {
+				list, err := parseOnionList(strings.NewReader(tt.allow))
+				require.Nil(t, err)
+				acl.allow = list
+			}
+			if tt.deny != "" {
+				list, err := parseOnionList(strings.NewReader(tt.deny))
+				require.Nil(t, err)
+				acl.deny = list
+			}
+			assert.Equal(t, tt.expected, acl.allowed(tt.target))
+		})
+	}
+}
+
+func TestProxyHandlerBlocked(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+
+	denylist := filepath.Join(t.TempDir(), "denylist")
+	require.Nil(t, os.WriteFile(denylist, []byte("*."+testOnionID+"\n"), 0o600))
+
+	socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+	app := newTestApplication(t, domain, socks.URL())
+	app.denylistPath = denylist
+	require.Nil(t, app.loadACL())
+
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = fmt.Sprintf("%s.%s", testOnionID, domain)
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, r)
+		return w
+	}
+
+	w := request()
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, w.Code)
+	assert.Contains(t, w.Body.String(), errOnionBlocked.Error())
+	assert.Contains(t, w.Body.String(), testOnionID+".onion")
+	assert.Empty(t, socks.Requests())
+
+	// an invalid file keeps the current lists
+	require.Nil(t, os.WriteFile(denylist, []byte("invalid\n"), 0o600))
+	app.reload()
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, request().Code)
+
+	// reloading without a restart unblocks the service
+	require.Nil(t, os.WriteFile(denylist, []byte("# empty\n"), 0o600))
+	app.reload()
+	w = request()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+	assert.Len(t, socks.Requests(), 1)
+}
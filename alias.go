@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var aliasNameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// aliasTable maps friendly names like forum.onion.tld to onion services
+type aliasTable struct {
+	byName    map[string]string
+	byService map[string]string
+}
+
+// loadAliases reads an alias file. Every line contains an alias and the onion
+// address separated by whitespace, empty lines and lines starting with # are
+// ignored:
+//
+//	forum duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion
+func loadAliases(path string) (*aliasTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open alias file: %w", err)
+	}
+	defer f.Close()
+	return parseAliases(f)
+}
+
+func parseAliases(r io.Reader) (*aliasTable, error) {
+	a := &aliasTable{
+		byName:    make(map[string]string),
+		byService: make(map[string]string),
+	}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected an alias and an onion address", lineNumber)
+		}
+		name := strings.ToLower(fields[0])
+		if !aliasNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("line %d: invalid alias %q", lineNumber, fields[0])
+		}
+		id, err := validateOnionID(strings.TrimSuffix(strings.ToLower(fields[1]), ".onion"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if _, ok := a.byName[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate alias %q", lineNumber, name)
+		}
+		if _, ok := a.byService[id]; ok {
+			return nil, fmt.Errorf("line %d: duplicate onion address %q", lineNumber, id)
+		}
+		a.byName[name] = id
+		a.byService[id] = name
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read alias file: %w", err)
+	}
+	return a, nil
+}
+
+// lookupName returns the onion service id for an alias
+func (a *aliasTable) lookupName(name string) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	id, ok := a.byName[strings.ToLower(name)]
+	return id, ok
+}
+
+// lookupService returns the alias for an onion service id
+func (a *aliasTable) lookupService(id string) (string, bool) {
+	if a == nil {
+		return "", false
+	}
+	name, ok := a.byService[strings.ToLower(id)]
+	return name, ok
+}
+
+func (a *aliasTable) Len() int {
+	if a == nil {
+		return 0
+	}
+	return len(a.byName)
+}
+
+// onionTarget resolves a host on the proxy domain to the onion service.
+// Aliases are consulted first, everything else needs to be a valid onion
+// address.
+func (app *application) onionTarget(hostname, port, domain string) (onionTarget, error) {
+	if len(hostname) > len(domain) && strings.EqualFold(hostname[len(hostname)-len(domain):], domain) {
+		target := newOnionTarget(strings.ToLower(hostname[:len(hostname)-len(domain)]), port)
+		if id, ok := app.aliases.lookupName(target.ServiceID); ok {
+			target.Alias = target.ServiceID
+			target.ServiceID = id
+			return target, nil
+		}
+	}
+	return parseOnionTarget(hostname, port, domain)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAliases(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected map[string]string
+		err      string
+	}{
+		{"empty", "", map[string]string{}, ""},
+		{"aliases", fmt.Sprintf("# comment\n\nforum %s.onion\nSearch  %s\n", testOnionID, strings.ToUpper(testOnionIDOther)), map[string]string{"forum": testOnionID, "search": testOnionIDOther}, ""},
+		{"missing address", "forum", nil, "line 1: expected an alias and an onion address"},
+		{"invalid alias", fmt.Sprintf("for.um %s", testOnionID), nil, "line 1: invalid alias"},
+		{"invalid address", "forum asdf.onion", nil, "line 1: invalid onion address"},
+		{"duplicate alias", fmt.Sprintf("forum %s\nforum %s", testOnionID, testOnionIDOther), nil, "line 2: duplicate alias"},
+		{"duplicate address", fmt.Sprintf("forum %s\nboard %s", testOnionID, testOnionID), nil, "line 2: duplicate onion address"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			aliases, err := parseAliases(strings.NewReader(tt.input))
+			if tt.err != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tt.expected, aliases.byName)
+			for name, id := range tt.expected {
+				alias, ok := aliases.lookupService(id)
+				assert.True(t, ok)
+				assert.Equal(t, name, alias)
+			}
+		})
+	}
+}
+
+func TestLinkRewriterAliases(t *testing.T) {
+	t.Parallel()
+
+	aliases, err := parseAliases(strings.NewReader(fmt.Sprintf("forum %s", testOnionID)))
+	require.Nil(t, err)
+	links := newLinkRewriter("onion.zwiebel")
+	links.aliases = aliases
+
+	assert.Equal(t, "http://forum.onion.zwiebel/x", links.rewriteURL(fmt.Sprintf("http://%s.onion/x", testOnionID)))
+	assert.Equal(t, "http://api.forum.onion.zwiebel:8080/x", links.rewriteURL(fmt.Sprintf("http://api.%s.onion:8080/x", testOnionID)))
+	assert.Equal(t, fmt.Sprintf("http://%s.onion.zwiebel/x", testOnionIDOther), links.rewriteURL(fmt.Sprintf("http://%s.onion/x", testOnionIDOther)))
+
+	assert.Equal(t, fmt.Sprintf("http://%s.onion/x", testOnionID), string(links.reverse([]byte("http://forum.onion.zwiebel/x"))))
+	assert.Equal(t, fmt.Sprintf("http://api.%s.onion/x", testOnionID), string(links.reverse([]byte("http://api.forum.onion.zwiebel/x"))))
+	assert.Equal(t, "http://asdf.onion/x", string(links.reverse([]byte("http://asdf.onion.zwiebel/x"))))
+
+	// urlencoded bodies
+	assert.Equal(t, fmt.Sprintf("url=http%%3A%%2F%%2F%s.onion%%2Fx", testOnionID), string(links.reverse([]byte("url=http%3A%2F%2Fforum.onion.zwiebel%2Fx"))))
+	assert.Equal(t, fmt.Sprintf("url=http%%3a%%2f%%2fapi.%s.onion", testOnionID), string(links.reverse([]byte("url=http%3a%2f%2fapi.forum.onion.zwiebel"))))
+	assert.Equal(t, "url=http%3A%2F%2Fasdf.onion%2Fx", string(links.reverse([]byte("url=http%3A%2F%2Fasdf.onion.zwiebel%2Fx"))))
+	assert.Equal(t, fmt.Sprintf("q=a%%20%s.onion", testOnionID), string(links.reverse([]byte("q=a%20forum.onion.zwiebel"))))
+
+	replacer := links.onionReplacer()
+	assert.Equal(t, "forum.onion.zwiebel/ asdf.onion.zwiebel/", string(replacer.replace([]byte(fmt.Sprintf("%s.onion/ asdf.onion/", testOnionID)))))
+}
+
+func TestProxyHandlerAlias(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Location", fmt.Sprintf("http://%s.onion/next", testOnionID))
+		fmt.Fprintf(w, `<a href="http://%s/a">a</a><a href="http://api.%s.onion/b">b</a>`, r.Host, testOnionID)
+	}))
+	defer upstream.Close()
+
+	aliases, err := parseAliases(strings.NewReader(fmt.Sprintf("forum %s", testOnionID)))
+	require.Nil(t, err)
+	socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+	app := newTestApplication(t, domain, socks.URL())
+	app.aliases = aliases
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = fmt.Sprintf("forum.%s", domain)
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	requests := socks.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, fmt.Sprintf("%s.onion", testOnionID), requests[0].Host)
+	assert.Equal(t, "http://forum.onion.zwiebel/next", w.Header().Get("Location"))
+	body, err := io.ReadAll(w.Body)
+	require.Nil(t, err)
+	assert.Equal(t, `<a href="http://forum.onion.zwiebel/a">a</a><a href="http://api.forum.onion.zwiebel/b">b</a>`, string(body))
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// loginPath and logoutPath are served on the proxy domain
+	loginPath  = "/login"
+	logoutPath = "/logout"
+	// authCookieName is the session cookie, it is valid for all subdomains
+	// of the proxy domain and never sent to the onion services
+	authCookieName = "zwiebelproxy_auth"
+)
+
+var errInvalidLogin = errors.New("invalid username or password")
+
+// authConfig holds the users and tokens that can access the proxy
+type authConfig struct {
+	// passwords are the bcrypt hashes by user
+	passwords map[string][]byte
+	// tokens maps the bearer tokens to their names
+	tokens map[string]string
+}
+
+// loadHtpasswd reads a htpasswd file with bcrypt hashes like the files
+// created by htpasswd -B. Empty lines and lines starting with # are ignored:
+//
+//	alice:$2y$10$...
+func loadHtpasswd(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open htpasswd file: %w", err)
+	}
+	defer f.Close()
+	users, err := parseHtpasswd(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return users, nil
+}
+
+func parseHtpasswd(r io.Reader) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash", lineNumber)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: only bcrypt hashes are supported: %w", lineNumber, err)
+		}
+		if _, ok := users[user]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %q", lineNumber, user)
+		}
+		users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read htpasswd file: %w", err)
+	}
+	return users, nil
+}
+
+// parseAuthTokens parses a comma separated list of name:token pairs
+func parseAuthTokens(s string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, token, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || token == "" {
+			return nil, fmt.Errorf("invalid token %q, expected name:token", name)
+		}
+		tokens[token] = name
+	}
+	return tokens, nil
+}
+
+// authEnabled reports if clients need to log in
+func (app *application) authEnabled() bool {
+	return app.htpasswdPath != "" || len(app.authTokens) > 0 || app.oidc != nil
+}
+
+// loadAuth (re)loads the htpasswd file. The current users stay active if the
+// file can not be loaded.
+func (app *application) loadAuth() error {
+	if !app.authEnabled() {
+		return nil
+	}
+	config := &authConfig{
+		passwords: make(map[string][]byte),
+		tokens:    app.authTokens,
+	}
+	if app.htpasswdPath != "" {
+		users, err := loadHtpasswd(app.htpasswdPath)
+		if err != nil {
+			return err
+		}
+		config.passwords = users
+	}
+	app.auth.Store(config)
+	return nil
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// checkPassword returns nil if the password of user is correct. Unknown
+// users take as long as known users so they can not be enumerated.
+func (c *authConfig) checkPassword(user, password string) error {
+	hash, ok := c.passwords[user]
+	if !ok {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("zwiebelproxy"), bcrypt.DefaultCost)
+		})
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return errInvalidLogin
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return errInvalidLogin
+	}
+	return nil
+}
+
+// tokenName returns the name of a bearer token
+func (c *authConfig) tokenName(token string) (string, bool) {
+	name := ""
+	found := false
+	for t, n := range c.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			name = n
+			found = true
+		}
+	}
+	return name, found
+}
+
+// sessionMethod is the login method of a session
+type sessionMethod string
+
+const (
+	sessionPassword sessionMethod = "password"
+	sessionOIDC     sessionMethod = "oidc"
+)
+
+// sign returns a value signed with the auth secret: <payload>.<hmac>
+func (app *application) sign(payload string) string {
+	mac := hmac.New(sha256.New, app.authSecret)
+	mac.Write([]byte(payload))
+	return fmt.Sprintf("%s.%s", payload, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// verifySignature returns the payload of a value created by sign
+func (app *application) verifySignature(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", false
+	}
+	payload, signature := value[:i], value[i+1:]
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, app.authSecret)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", false
+	}
+	return payload, true
+}
+
+// signSession returns the value of the session cookie:
+// <method>.<base64 user>.<expiry>.<hmac>
+func (app *application) signSession(method sessionMethod, user string, expiry time.Time) string {
+	return app.sign(fmt.Sprintf("%s.%s.%d", method, base64.RawURLEncoding.EncodeToString([]byte(user)), expiry.Unix()))
+}
+
+// verifySession returns the login method and the user of a valid session
+// cookie
+func (app *application) verifySession(value string) (sessionMethod, string, bool) {
+	payload, ok := app.verifySignature(value)
+	if !ok {
+		return "", "", false
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 {
+		return "", "", false
+	}
+	unix, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().After(time.Unix(unix, 0)) {
+		return "", "", false
+	}
+	user, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+	return sessionMethod(parts[0]), string(user), true
+}
+
+// authenticate returns the user of a request authenticated by a bearer token
+// or a session cookie. Sessions of users removed from the htpasswd file are
+// no longer valid.
+func (app *application) authenticate(r *http.Request) (string, bool) {
+	config := app.auth.Load()
+	if config == nil {
+		return "", false
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if name, ok := config.tokenName(token); ok {
+			return name, true
+		}
+	}
+	if cookie, err := r.Cookie(authCookieName); err == nil {
+		method, user, ok := app.verifySession(cookie.Value)
+		if !ok {
+			return "", false
+		}
+		switch method {
+		case sessionPassword:
+			if _, ok := config.passwords[user]; ok {
+				return user, true
+			}
+		case sessionOIDC:
+			if app.oidc != nil {
+				return user, true
+			}
+		}
+	}
+	return "", false
+}
+
+// authMiddleware only lets authenticated requests through. Browsers are
+// redirected to the login page on the proxy domain.
+func (app *application) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := app.proxyHost(r); ok {
+			switch r.URL.Path {
+			case loginPath, logoutPath, oidcStartPath, oidcCallbackPath, statusPath, newnymPath:
+				// these handle authentication themselves or are public
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		user, ok := app.authenticate(r)
+		if !ok {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				if loginURL, ok := app.loginURL(r); ok {
+					http.Redirect(w, r, loginURL, http.StatusFound)
+					return
+				}
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			app.logError(w, errors.New("please log in to use this proxy"), http.StatusUnauthorized)
+			return
+		}
+
+		// the credentials of the proxy are not sent to the onion services
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			if _, ok := app.auth.Load().tokenName(token); ok {
+				r.Header.Del("Authorization")
+			}
+		}
+		next.ServeHTTP(w, withUser(r, user))
+	})
+}
+
+// proxyURL returns the url of the proxy domain matching the request with
+// the port the client used
+func (app *application) proxyURL(r *http.Request) (*url.URL, bool) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// no port present
+		host = r.Host
+	}
+	domain, ok := app.matchDomain(strings.ToLower(host))
+	if !ok {
+		return nil, false
+	}
+	u := &url.URL{
+		Scheme: clientScheme(r),
+		Host:   strings.TrimLeft(domain, "."),
+	}
+	if port != "" {
+		u.Host = net.JoinHostPort(u.Host, port)
+	}
+	return u, true
+}
+
+// loginURL returns the login page with the current url as redirect target.
+// Without a htpasswd file users are sent to the identity provider directly.
+func (app *application) loginURL(r *http.Request) (string, bool) {
+	u, ok := app.proxyURL(r)
+	if !ok {
+		return "", false
+	}
+	current := url.URL{
+		Scheme:   clientScheme(r),
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
+	u.Path = loginPath
+	if app.htpasswdPath == "" && app.oidc != nil {
+		u.Path = oidcStartPath
+	}
+	u.RawQuery = url.Values{"next": []string{current.String()}}.Encode()
+	return u.String(), true
+}
+
+// redirectTarget returns next if it points to the proxy domain or one of its
+// subdomains so the login can not be used as an open redirect
+func (app *application) redirectTarget(r *http.Request, next string) string {
+	fallback := "/"
+	u, err := url.Parse(next)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fallback
+	}
+	domain, ok := app.matchDomain(strings.ToLower(u.Hostname()))
+	if !ok || domain != app.requestDomain(r) {
+		return fallback
+	}
+	return u.String()
+}
+
+// authCookie returns the session cookie for the proxy domain of the request
+func (app *application) authCookie(r *http.Request, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     authCookieName,
+		Value:    value,
+		Path:     "/",
+		Domain:   strings.TrimLeft(app.requestDomain(r), "."),
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.EqualFold(clientScheme(r), "https"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// loginHandler renders the login form and creates a session for valid
+// credentials
+func (app *application) loginHandler(w http.ResponseWriter, r *http.Request) {
+	domain, ok := app.proxyHost(r)
+	if !ok {
+		app.proxyHandler(w, r)
+		return
+	}
+	r = withProxyDomain(r, domain)
+
+	data := struct {
+		Next     string
+		Error    string
+		Password bool
+		OIDC     bool
+	}{
+		Next:     r.URL.Query().Get("next"),
+		Password: app.htpasswdPath != "" || app.oidc == nil,
+		OIDC:     app.oidc != nil,
+	}
+	statusCode := http.StatusOK
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		user := r.PostFormValue("username")
+		data.Next = r.PostFormValue("next")
+		if err := app.auth.Load().checkPassword(user, r.PostFormValue("password")); err != nil {
+			app.logger.Infof("failed login of user %q from %s", sanitizeString(user), r.RemoteAddr)
+			if app.JsonLoggerEnabled {
+				message := fmt.Sprintf("failed login of user %q from %s", sanitizeString(user), r.RemoteAddr)
+				app.JsonLogger.DebugLevel(message)
+			}
+			data.Error = err.Error()
+			statusCode = http.StatusUnauthorized
+			break
+		}
+		expires := time.Now().Add(app.authSessionLifetime)
+		http.SetCookie(w, app.authCookie(r, app.signSession(sessionPassword, user, expires), expires))
+		http.Redirect(w, r, app.redirectTarget(r, data.Next), http.StatusSeeOther)
+		return
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	if err := app.templates.ExecuteTemplate(w, "login.tmpl", data); err != nil {
+		app.logger.Error(err)
+		if app.JsonLoggerEnabled {
+			app.JsonLogger.ErrorLevel(err.Error())
+		}
+	}
+}
+
+// logoutHandler removes the session cookie
+func (app *application) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	domain, ok := app.proxyHost(r)
+	if !ok {
+		app.proxyHandler(w, r)
+		return
+	}
+	r = withProxyDomain(r, domain)
+
+	cookie := app.authCookie(r, "", time.Unix(0, 0))
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+	http.Redirect(w, r, loginPath, http.StatusSeeOther)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testHtpasswd(t *testing.T, users map[string]string) string {
+	t.Helper()
+
+	var lines []string
+	for user, password := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		require.Nil(t, err)
+		lines = append(lines, fmt.Sprintf("%s:%s", user, hash))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+		err      string
+	}{
+		{"bcrypt", "# comment\n\n" + testHtpasswd(t, map[string]string{"alice": "secret"}), []string{"alice"}, ""},
+		{"apache prefix", "bob:$2y$05$8l3Lb6/K2LxvoXhM5cXy4uPMS6JQnszfB6N8jvRZC6l5O0eJV3ZHq\n", []string{"bob"}, ""},
+		{"md5", "alice:$apr1$x0qRiq7R$Rwmm.ZW9kbJ1IjmMaAiSE0\n", nil, "line 1: only bcrypt hashes are supported"},
+		{"no hash", "alice\n", nil, "line 1: expected user:hash"},
+		{"duplicate", testHtpasswd(t, map[string]string{"alice": "secret"}) + "\n" + testHtpasswd(t, map[string]string{"alice": "other"}), nil, "line 2: duplicate user"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			users, err := parseHtpasswd(strings.NewReader(tt.input))
+			if tt.err != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.Nil(t, err)
+			var names []string
+			for user := range users {
+				names = append(names, user)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestParseAuthTokens(t *testing.T) {
+	t.Parallel()
+
+	tokens, err := parseAuthTokens(" ci:abc , monitoring:d:e,")
+	require.Nil(t, err)
+	assert.Equal(t, map[string]string{"abc": "ci", "d:e": "monitoring"}, tokens)
+
+	_, err = parseAuthTokens("abc")
+	assert.NotNil(t, err)
+	_, err = parseAuthTokens("ci:")
+	assert.NotNil(t, err)
+}
+
+func TestSession(t *testing.T) {
+	t.Parallel()
+
+	app := newTestApplication(t, "onion.zwiebel", "socks5://127.0.0.1:9050")
+	app.authSecret = []byte("secret")
+
+	value := app.signSession(sessionPassword, "alice.bob", time.Now().Add(time.Hour))
+	method, user, ok := app.verifySession(value)
+	assert.True(t, ok)
+	assert.Equal(t, sessionPassword, method)
+	assert.Equal(t, "alice.bob", user)
+
+	// tampered user
+	parts := strings.Split(value, ".")
+	parts[1] = "YWRtaW4"
+	_, _, ok = app.verifySession(strings.Join(parts, "."))
+	assert.False(t, ok)
+
+	// tampered method
+	parts = strings.Split(value, ".")
+	parts[0] = string(sessionOIDC)
+	_, _, ok = app.verifySession(strings.Join(parts, "."))
+	assert.False(t, ok)
+
+	// expired
+	_, _, ok = app.verifySession(app.signSession(sessionPassword, "alice", time.Now().Add(-time.Second)))
+	assert.False(t, ok)
+
+	// different secret
+	other := newTestApplication(t, "onion.zwiebel", "socks5://127.0.0.1:9050")
+	other.authSecret = []byte("other")
+	_, _, ok = other.verifySession(value)
+	assert.False(t, ok)
+
+	_, _, ok = app.verifySession("invalid")
+	assert.False(t, ok)
+}
+
+func TestAuth(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "authorization=%s cookie=%s", r.Header.Get("Authorization"), r.Header.Get("Cookie"))
+	}))
+	defer upstream.Close()
+
+	socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+	app := newTestApplication(t, domain, socks.URL())
+	app.htpasswdPath = filepath.Join(t.TempDir(), "htpasswd")
+	require.Nil(t, os.WriteFile(app.htpasswdPath, []byte(testHtpasswd(t, map[string]string{"alice": "secret"})), 0o600))
+	app.authTokens = map[string]string{"token": "ci"}
+	app.authSecret = []byte("secret")
+	app.authSessionLifetime = time.Hour
+	require.Nil(t, app.loadAuth())
+	handler := app.routes()
+
+	onionURL := fmt.Sprintf("http://%s.%s/path?a=b", testOnionID, domain)
+	request := func(method, target string, body url.Values, header http.Header) *httptest.ResponseRecorder {
+		var r *http.Request
+		if body != nil {
+			r = httptest.NewRequest(method, target, strings.NewReader(body.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest(method, target, nil)
+		}
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// browsers are sent to the login page
+	w := request(http.MethodGet, onionURL, nil, nil)
+	assert.Equal(t, http.StatusFound, w.Code)
+	loginURL := fmt.Sprintf("http://%s%s?next=%s", domain, loginPath, url.QueryEscape(onionURL))
+	assert.Equal(t, loginURL, w.Header().Get("Location"))
+	assert.Empty(t, socks.Requests())
+
+	// other clients get a 401
+	w = request(http.MethodPost, onionURL, nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+
+	// the proxy domain is protected too, the status endpoint is not
+	assert.Equal(t, http.StatusFound, request(http.MethodGet, fmt.Sprintf("http://%s/", domain), nil, nil).Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, fmt.Sprintf("http://%s%s", domain, statusPath), nil, nil).Code)
+
+	// bearer tokens are not sent to the onion service
+	w = request(http.MethodGet, onionURL, nil, http.Header{"Authorization": {"Bearer token"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "authorization= cookie=", w.Body.String())
+	w = request(http.MethodGet, onionURL, nil, http.Header{"Authorization": {"Bearer wrong"}})
+	assert.Equal(t, http.StatusFound, w.Code)
+
+	// login form
+	w = request(http.MethodGet, loginURL, nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `<form method="post" action="/login">`)
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`value="http://%s.%s/path?a=b"`, testOnionID, domain))
+	w = request(http.MethodGet, fmt.Sprintf("http://%s%s?next=%s", domain, loginPath, url.QueryEscape(`"><script>`)), nil, nil)
+	assert.NotContains(t, w.Body.String(), "<script>")
+
+	// wrong credentials
+	w = request(http.MethodPost, fmt.Sprintf("http://%s%s", domain, loginPath), url.Values{"username": {"alice"}, "password": {"wrong"}, "next": {onionURL}}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), errInvalidLogin.Error())
+	w = request(http.MethodPost, fmt.Sprintf("http://%s%s", domain, loginPath), url.Values{"username": {"bob"}, "password": {"secret"}}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, w.Result().Cookies())
+
+	// open redirects are not possible
+	w = request(http.MethodPost, fmt.Sprintf("http://%s%s", domain, loginPath), url.Values{"username": {"alice"}, "password": {"secret"}, "next": {"https://evil.example/"}}, nil)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/", w.Header().Get("Location"))
+
+	// valid credentials
+	w = request(http.MethodPost, fmt.Sprintf("http://%s%s", domain, loginPath), url.Values{"username": {"alice"}, "password": {"secret"}, "next": {onionURL}}, nil)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, onionURL, w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, authCookieName, cookies[0].Name)
+	assert.Equal(t, domain, cookies[0].Domain)
+	assert.True(t, cookies[0].HttpOnly)
+
+	// the session cookie is valid for all onion services and never sent to them
+	cookie := fmt.Sprintf("%s=%s; other=1", authCookieName, cookies[0].Value)
+	w = request(http.MethodGet, onionURL, nil, http.Header{"Cookie": {cookie}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "authorization= cookie=other=1", w.Body.String())
+	w = request(http.MethodGet, fmt.Sprintf("http://%s.%s/", testOnionIDOther, domain), nil, http.Header{"Cookie": {cookie}})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// logout removes the cookie
+	w = request(http.MethodGet, fmt.Sprintf("http://%s%s", domain, logoutPath), nil, http.Header{"Cookie": {cookie}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	cookies = w.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, authCookieName, cookies[0].Name)
+	assert.Equal(t, -1, cookies[0].MaxAge)
+
+	// sessions of removed users are invalid
+	require.Nil(t, os.WriteFile(app.htpasswdPath, []byte(testHtpasswd(t, map[string]string{"bob": "secret"})), 0o600))
+	app.reload()
+	assert.Equal(t, http.StatusFound, request(http.MethodGet, onionURL, nil, http.Header{"Cookie": {cookie}}).Code)
+}
+
+func TestAuthUser(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+
+	socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+	app := newTestApplication(t, domain, socks.URL())
+	app.authTokens = map[string]string{"alice-token": "alice", "bob-token": "bob"}
+	require.Nil(t, app.loadAuth())
+	store, err := parseClientAuth(strings.NewReader(fmt.Sprintf("%s:descriptor:x25519:%s alice\n", testOnionID, testClientAuthKey('a'))))
+	require.Nil(t, err)
+	app.clientAuth.Store(store)
+
+	request := func(token string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = fmt.Sprintf("%s.%s", testOnionID, domain)
+		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// the logged in user is used for the client authorization
+	assert.Equal(t, http.StatusOK, request("alice-token"))
+	assert.Equal(t, http.StatusForbidden, request("bob-token"))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+var errClientBlocked = errors.New("your ip address is not allowed to use this proxy")
+
+// clientRules decide which client addresses are allowed. Denied networks are
+// always blocked, if allowed networks are configured only clients in them
+// are allowed.
+type clientRules struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func (c clientRules) empty() bool {
+	return len(c.allow) == 0 && len(c.deny) == 0
+}
+
+func (c clientRules) allowed(addr netip.Addr, ok bool) bool {
+	if c.empty() {
+		return true
+	}
+	if !ok || containsAddr(c.deny, addr) {
+		return false
+	}
+	return len(c.allow) == 0 || containsAddr(c.allow, addr)
+}
+
+// clientACL holds the global rules and the rules of onion services
+// overriding them
+type clientACL struct {
+	global   clientRules
+	exact    map[string]clientRules
+	wildcard map[string]clientRules
+}
+
+// loadClientACL reads the per onion overrides. Every line contains an onion
+// host like in the allowlist, allow or deny and a comma separated list of
+// networks. All lines of a host replace the global rules for it. Empty lines
+// and lines starting with # are ignored:
+//
+//	# only reachable from the office
+//	*.duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion allow 192.0.2.0/24,2001:db8::/32
+//	# reachable from everywhere except one network
+//	api.duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion deny 198.51.100.0/24
+func loadClientACL(path string) (*clientACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open client acl file: %w", err)
+	}
+	defer f.Close()
+	acl, err := parseClientACL(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return acl, nil
+}
+
+func parseClientACL(r io.Reader) (*clientACL, error) {
+	a := &clientACL{
+		exact:    make(map[string]clientRules),
+		wildcard: make(map[string]clientRules),
+	}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected an onion address, allow or deny and a list of networks", lineNumber)
+		}
+		host := strings.ToLower(fields[0])
+		wildcard := strings.HasPrefix(host, "*.")
+		host = strings.TrimPrefix(host, "*.")
+		if !strings.HasSuffix(host, ".onion") {
+			host = fmt.Sprintf("%s.onion", host)
+		}
+		target, err := parseOnionTarget(host, "", ".onion")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if wildcard && len(target.Subdomains) > 0 {
+			return nil, fmt.Errorf("line %d: wildcards are only supported in front of the service id", lineNumber)
+		}
+		prefixes, err := parsePrefixes(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		rules, key := a.exact, target.Hostname()
+		if wildcard {
+			rules, key = a.wildcard, target.ServiceID
+		}
+		entry := rules[key]
+		switch strings.ToLower(fields[1]) {
+		case "allow":
+			entry.allow = append(entry.allow, prefixes...)
+		case "deny":
+			entry.deny = append(entry.deny, prefixes...)
+		default:
+			return nil, fmt.Errorf("line %d: invalid action %q, expected allow or deny", lineNumber, fields[1])
+		}
+		rules[key] = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read client acl file: %w", err)
+	}
+	return a, nil
+}
+
+// onionRules returns the rules of an onion service, exact entries win over
+// wildcards and both win over the global rules
+func (a *clientACL) onionRules(target onionTarget) clientRules {
+	if rules, ok := a.exact[target.Hostname()]; ok {
+		return rules
+	}
+	if rules, ok := a.wildcard[target.ServiceID]; ok {
+		return rules
+	}
+	return a.global
+}
+
+// allowedOnion reports if the client of the request can reach the onion
+// service
+func (a *clientACL) allowedOnion(r *http.Request, target onionTarget) bool {
+	if a == nil {
+		return true
+	}
+	addr, ok := clientAddr(r)
+	return a.onionRules(target).allowed(addr, ok)
+}
+
+// allowedProxy reports if the client of the request can use the pages of the
+// proxy domain like the login
+func (a *clientACL) allowedProxy(r *http.Request) bool {
+	if a == nil {
+		return true
+	}
+	addr, ok := clientAddr(r)
+	return a.global.allowed(addr, ok)
+}
+
+// loadClientACL (re)loads the per onion overrides from disk. The current
+// rules stay active if the file can not be loaded.
+func (app *application) loadClientACL() error {
+	acl := &clientACL{
+		global: app.clientRules,
+	}
+	if app.clientACLPath != "" {
+		loaded, err := loadClientACL(app.clientACLPath)
+		if err != nil {
+			return err
+		}
+		acl.exact = loaded.exact
+		acl.wildcard = loaded.wildcard
+	}
+	app.clientACL.Store(acl)
+	return nil
+}
+
+// clientACLMiddleware blocks clients from the pages of the proxy domain.
+// Requests to onion services are checked in serveOnion as the rules of the
+// service may override the global rules.
+func (app *application) clientACLMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := app.proxyHost(r); ok && !(app.pathMode && strings.HasPrefix(r.URL.Path, pathPrefix)) {
+			if !app.clientACL.Load().allowedProxy(r) {
+				app.logger.Infof("blocked request from %s to the proxy domain", sanitizeString(r.RemoteAddr))
+				if app.JsonLoggerEnabled {
+					message := fmt.Sprintf("blocked request from %s to the proxy domain", sanitizeString(r.RemoteAddr))
+					app.JsonLogger.DebugLevel(message)
+				}
+				app.renderError(w, http.StatusForbidden, errorPage{Error: errClientBlocked.Error()})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
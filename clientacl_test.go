@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClientACL(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"valid", fmt.Sprintf("# comment\n\n*.%s allow 192.0.2.0/24,2001:db8::/32\napi.%s deny 198.51.100.1\n%s.onion allow 10.0.0.0/8\n%s deny 10.1.0.0/16", testOnionID, testOnionID, testOnionIDOther, testOnionIDOther), ""},
+		{"missing networks", fmt.Sprintf("%s allow", testOnionID), "line 1: expected"},
+		{"invalid action", fmt.Sprintf("%s permit 10.0.0.0/8", testOnionID), "line 1: invalid action"},
+		{"invalid network", fmt.Sprintf("%s allow 10.0.0.0/99", testOnionID), "line 1: invalid network"},
+		{"invalid onion", "invalid allow 10.0.0.0/8", "line 1:"},
+		{"wildcard subdomain", fmt.Sprintf("*.api.%s allow 10.0.0.0/8", testOnionID), "line 1: wildcards"},
+	}
+
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			acl, err := parseClientACL(strings.NewReader(tt.input))
+			if tt.err != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Len(t, acl.wildcard, 1)
+			assert.Len(t, acl.exact, 2)
+			assert.Len(t, acl.exact[testOnionIDOther+".onion"].allow, 1)
+			assert.Len(t, acl.exact[testOnionIDOther+".onion"].deny, 1)
+		})
+	}
+}
+
+func TestClientACL(t *testing.T) {
+	t.Parallel()
+
+	acl, err := parseClientACL(strings.NewReader(fmt.Sprintf("*.%s allow 192.0.2.0/24\napi.%s deny 198.51.100.0/24", testOnionID, testOnionID)))
+	require.Nil(t, err)
+	acl.global = clientRules{
+		allow: []netip.Prefix{netip.MustParsePrefix("198.51.100.0/24"), netip.MustParsePrefix("203.0.113.0/24")},
+		deny:  []netip.Prefix{netip.MustParsePrefix("203.0.113.128/25")},
+	}
+
+	service := onionTarget{ServiceID: testOnionID}
+	subdomain := onionTarget{ServiceID: testOnionID, Subdomains: []string{"api"}}
+	other := onionTarget{ServiceID: testOnionIDOther}
+
+	tests := []struct {
+		name     string
+		addr     string
+		target   *onionTarget
+		expected bool
+	}{
+		{"global allowed", "203.0.113.1", nil, true},
+		{"global denied", "203.0.113.200", nil, false},
+		{"global not allowed", "192.0.2.1", nil, false},
+		{"invalid address", "invalid", nil, false},
+		{"onion without override", "203.0.113.1", &other, true},
+		{"onion without override denied", "192.0.2.1", &other, false},
+		{"wildcard override allows", "192.0.2.1", &service, true},
+		{"wildcard override replaces global", "203.0.113.1", &service, false},
+		{"exact override wins", "203.0.113.1", &subdomain, true},
+		{"exact override denies", "198.51.100.1", &subdomain, false},
+	}
+
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.addr
+			if tt.target == nil {
+				assert.Equal(t, tt.expected, acl.allowedProxy(r))
+				return
+			}
+			assert.Equal(t, tt.expected, acl.allowedOnion(r, *tt.target))
+		})
+	}
+
+	// no rules
+	var empty *clientACL
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.True(t, empty.allowedProxy(r))
+	assert.True(t, (&clientACL{}).allowedOnion(r, service))
+}
+
+func TestProxyHandlerClientBlocked(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+
+	aclFile := filepath.Join(t.TempDir(), "client-acl")
+	require.Nil(t, os.WriteFile(aclFile, []byte(fmt.Sprintf("*.%s allow 192.0.2.0/24\n", testOnionIDOther)), 0o600))
+
+	socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+	app := newTestApplication(t, domain, socks.URL())
+	app.trustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	app.clientRules = clientRules{allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	app.clientACLPath = aclFile
+	require.Nil(t, app.loadClientACL())
+	handler := app.routes()
+
+	request := func(host, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = host
+		r.RemoteAddr = remoteAddr
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	onion := fmt.Sprintf("%s.%s", testOnionID, domain)
+	otherOnion := fmt.Sprintf("%s.%s", testOnionIDOther, domain)
+
+	// the global rules apply to the proxy domain and onion services
+	w := request(domain, "192.0.2.1:1234", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), errClientBlocked.Error())
+	assert.Equal(t, http.StatusOK, request(domain, "10.0.0.1:1234", nil).Code)
+	assert.Equal(t, http.StatusForbidden, request(onion, "192.0.2.1:1234", nil).Code)
+	assert.Empty(t, socks.Requests())
+	w = request(onion, "10.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+
+	// the override replaces the global rules
+	assert.Equal(t, http.StatusOK, request(otherOnion, "192.0.2.1:1234", nil).Code)
+	assert.Equal(t, http.StatusForbidden, request(otherOnion, "10.0.0.1:1234", nil).Code)
+
+	// only trusted proxies can set the client address
+	assert.Equal(t, http.StatusForbidden, request(onion, "192.0.2.1:1234", http.Header{"X-Real-Ip": {"10.0.0.1"}}).Code)
+	assert.Equal(t, http.StatusForbidden, request(onion, "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.1"}}).Code)
+	assert.Equal(t, http.StatusOK, request(onion, "127.0.0.1:1234", http.Header{"X-Real-Ip": {"10.0.0.1"}}).Code)
+	assert.Equal(t, http.StatusForbidden, request(onion, "127.0.0.1:1234", http.Header{"X-Real-Ip": {"192.0.2.1"}}).Code)
+
+	// an invalid file keeps the current rules
+	require.Nil(t, os.WriteFile(aclFile, []byte("invalid\n"), 0o600))
+	app.reload()
+	assert.Equal(t, http.StatusOK, request(otherOnion, "192.0.2.1:1234", nil).Code)
+
+	// reloading removes the override
+	require.Nil(t, os.WriteFile(aclFile, []byte("# empty\n"), 0o600))
+	app.reload()
+	assert.Equal(t, http.StatusForbidden, request(otherOnion, "192.0.2.1:1234", nil).Code)
+	assert.Equal(t, http.StatusOK, request(otherOnion, "10.0.0.1:1234", nil).Code)
+}
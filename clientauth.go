@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+var errOnionUnauthorized = errors.New("you are not authorized to access this onion service on this proxy")
+
+// clientAuthKey is the x25519 key of a v3 onion service with client
+// authorization
+type clientAuthKey struct {
+	ServiceID string
+	// Key is the private key in base32 like in the .auth_private files of TOR
+	Key string
+	// Users can access the service through the proxy, everybody if empty
+	Users map[string]bool
+}
+
+// clientAuthStore holds the client authorization keys by service id
+type clientAuthStore struct {
+	keys map[string]*clientAuthKey
+}
+
+// loadClientAuth reads a key file. Every line contains a key in the format of
+// the .auth_private files of TOR, optionally followed by the users allowed to
+// access the service separated by a comma. Empty lines and lines starting
+// with # are ignored:
+//
+//	duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad:descriptor:x25519:<base32 key> alice,bob
+func loadClientAuth(path string) (*clientAuthStore, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open client authorization file: %w", err)
+	}
+	defer f.Close()
+	store, err := parseClientAuth(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return store, nil
+}
+
+func parseClientAuth(r io.Reader) (*clientAuthStore, error) {
+	s := &clientAuthStore{
+		keys: make(map[string]*clientAuthKey),
+	}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected a key and an optional list of users", lineNumber)
+		}
+		parts := strings.Split(fields[0], ":")
+		if len(parts) != 4 || parts[1] != "descriptor" || parts[2] != "x25519" {
+			return nil, fmt.Errorf("line %d: expected <onion address>:descriptor:x25519:<key>", lineNumber)
+		}
+		id, err := validateOnionID(strings.TrimSuffix(strings.ToLower(parts[0]), ".onion"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		key := strings.ToUpper(parts[3])
+		if _, err := decodeClientAuthKey(key); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if _, ok := s.keys[id]; ok {
+			return nil, fmt.Errorf("line %d: duplicate onion address %q", lineNumber, id)
+		}
+		k := &clientAuthKey{
+			ServiceID: id,
+			Key:       key,
+			Users:     make(map[string]bool),
+		}
+		if len(fields) == 2 {
+			for _, user := range strings.Split(fields[1], ",") {
+				if user = strings.TrimSpace(user); user != "" {
+					k.Users[user] = true
+				}
+			}
+		}
+		s.keys[id] = k
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read client authorization file: %w", err)
+	}
+	return s, nil
+}
+
+// decodeClientAuthKey decodes a base32 x25519 private key
+func decodeClientAuthKey(key string) ([]byte, error) {
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(key, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid x25519 key: %w", err)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("invalid x25519 key: expected 32 bytes, got %d", len(raw))
+	}
+	return raw, nil
+}
+
+// authorized reports if user can access the onion service. Services without
+// a key or without a list of users are open to everybody.
+func (s *clientAuthStore) authorized(target onionTarget, user string) bool {
+	if s == nil {
+		return true
+	}
+	k, ok := s.keys[target.ServiceID]
+	if !ok || len(k.Users) == 0 {
+		return true
+	}
+	return user != "" && k.Users[user]
+}
+
+// requestUser returns the user logged in to the proxy or the user
+// authenticated by the reverse proxy in front of this proxy, the header is
+// only trusted if it is configured and sent by a trusted proxy
+func (app *application) requestUser(r *http.Request) string {
+	if user, ok := userFromRequest(r); ok {
+		return user
+	}
+	if app.userHeader == "" || !fromTrustedProxy(r) {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(app.userHeader))
+}
+
+// serviceIDs returns the sorted service ids of all keys
+func (s *clientAuthStore) serviceIDs() []string {
+	if s == nil {
+		return nil
+	}
+	ids := make([]string, 0, len(s.keys))
+	for id := range s.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// addClientAuth adds the key of an onion service to TOR. Keys added this way
+// are lost when TOR restarts.
+// https://spec.torproject.org/control-spec/commands.html#onion_client_auth_add
+func (c *torControl) addClientAuth(ctx context.Context, k *clientAuthKey) error {
+	raw, err := decodeClientAuthKey(k.Key)
+	if err != nil {
+		return err
+	}
+	_, err = c.command(ctx, fmt.Sprintf("ONION_CLIENT_AUTH_ADD %s x25519:%s", k.ServiceID, base64.StdEncoding.EncodeToString(raw)))
+	return err
+}
+
+// removeClientAuth removes the key of an onion service from TOR
+// https://spec.torproject.org/control-spec/commands.html#onion_client_auth_remove
+func (c *torControl) removeClientAuth(ctx context.Context, serviceID string) error {
+	_, err := c.command(ctx, fmt.Sprintf("ONION_CLIENT_AUTH_REMOVE %s", serviceID))
+	return err
+}
+
+// loadClientAuth (re)loads the client authorization keys and pushes them to
+// TOR. Keys that were removed from the file are removed from TOR. The current
+// keys stay active if the file can not be loaded.
+func (app *application) loadClientAuth(ctx context.Context) error {
+	if app.clientAuthPath == "" {
+		return nil
+	}
+	store, err := loadClientAuth(app.clientAuthPath)
+	if err != nil {
+		return err
+	}
+	old := app.clientAuth.Swap(store)
+
+	var errs []error
+	for _, id := range old.serviceIDs() {
+		if _, ok := store.keys[id]; ok {
+			continue
+		}
+		if err := app.control.removeClientAuth(ctx, id); err != nil {
+			errs = append(errs, fmt.Errorf("could not remove the client authorization key of %s: %w", id, err))
+		}
+	}
+	for _, id := range store.serviceIDs() {
+		if err := app.control.addClientAuth(ctx, store.keys[id]); err != nil {
+			errs = append(errs, fmt.Errorf("could not add the client authorization key of %s: %w", id, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	app.logger.Infof("added %d client authorization keys to TOR", len(store.keys))
+	if app.JsonLoggerEnabled {
+		message := fmt.Sprintf("added %d client authorization keys to TOR", len(store.keys))
+		app.JsonLogger.DebugLevel(message)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testClientAuthKey(b byte) string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte(strings.Repeat(string(rune(b)), 32)))
+}
+
+func TestParseClientAuth(t *testing.T) {
+	t.Parallel()
+
+	key := testClientAuthKey('a')
+	tests := []struct {
+		name     string
+		input    string
+		expected map[string]*clientAuthKey
+		err      string
+	}{
+		{"empty", "# comment\n\n", map[string]*clientAuthKey{}, ""},
+		{"key", fmt.Sprintf("%s:descriptor:x25519:%s\n", testOnionID, key), map[string]*clientAuthKey{
+			testOnionID: {ServiceID: testOnionID, Key: key, Users: map[string]bool{}},
+		}, ""},
+		{"users", fmt.Sprintf("%s.onion:descriptor:x25519:%s alice,bob\n", strings.ToUpper(testOnionID), strings.ToLower(key)), map[string]*clientAuthKey{
+			testOnionID: {ServiceID: testOnionID, Key: key, Users: map[string]bool{"alice": true, "bob": true}},
+		}, ""},
+		{"invalid format", fmt.Sprintf("%s:x25519:%s\n", testOnionID, key), nil, "line 1: expected <onion address>:descriptor:x25519:<key>"},
+		{"invalid onion", fmt.Sprintf("invalid:descriptor:x25519:%s\n", key), nil, "line 1"},
+		{"invalid key", fmt.Sprintf("%s:descriptor:x25519:AAAA\n", testOnionID), nil, "line 1: invalid x25519 key"},
+		{"too many fields", fmt.Sprintf("%s:descriptor:x25519:%s alice bob\n", testOnionID, key), nil, "line 1: expected a key and an optional list of users"},
+		{"duplicate", fmt.Sprintf("%s:descriptor:x25519:%s\n%s:descriptor:x25519:%s\n", testOnionID, key, testOnionID, key), nil, "line 2: duplicate onion address"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			store, err := parseClientAuth(strings.NewReader(tt.input))
+			if tt.err != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tt.expected, store.keys)
+		})
+	}
+}
+
+func TestClientAuthStoreAuthorized(t *testing.T) {
+	t.Parallel()
+
+	store, err := parseClientAuth(strings.NewReader(fmt.Sprintf("%s:descriptor:x25519:%s alice\n%s:descriptor:x25519:%s\n", testOnionID, testClientAuthKey('a'), testOnionIDOther, testClientAuthKey('b'))))
+	require.Nil(t, err)
+
+	tests := []struct {
+		name      string
+		store     *clientAuthStore
+		serviceID string
+		user      string
+		expected  bool
+	}{
+		{"no store", nil, testOnionID, "", true},
+		{"listed user", store, testOnionID, "alice", true},
+		{"other user", store, testOnionID, "bob", false},
+		{"no user", store, testOnionID, "", false},
+		{"service without users", store, testOnionIDOther, "", true},
+		{"service without key", store, strings.Repeat("a", 56), "", true},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.expected, tt.store.authorized(newOnionTarget(tt.serviceID, ""), tt.user))
+		})
+	}
+}
+
+func TestLoadClientAuth(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the user header is not sent to the onion service
+		fmt.Fprintf(w, "user=%s", r.Header.Get("X-Forwarded-User"))
+	}))
+	defer upstream.Close()
+
+	control := newFakeControlServer(t, "", nil)
+	socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+	app := newTestApplication(t, domain, socks.URL())
+	app.control = newTorControl(control.listener.Addr().String(), "", "", time.Second)
+	app.userHeader = "X-Forwarded-User"
+	app.trustedProxies = []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32")}
+	app.clientAuthPath = filepath.Join(t.TempDir(), "client_auth")
+	require.Nil(t, os.WriteFile(app.clientAuthPath, []byte(fmt.Sprintf("%s:descriptor:x25519:%s alice\n%s:descriptor:x25519:%s\n", testOnionID, testClientAuthKey('a'), testOnionIDOther, testClientAuthKey('b'))), 0o600))
+	require.Nil(t, app.loadClientAuth(context.Background()))
+	assert.Equal(t, map[string]string{
+		testOnionID:      "x25519:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32))),
+		testOnionIDOther: "x25519:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32))),
+	}, control.ClientAuth())
+
+	request := func(user string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		r.Host = fmt.Sprintf("%s.%s", testOnionID, domain)
+		if user != "" {
+			r.Header.Set("X-Forwarded-User", user)
+		}
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), errOnionUnauthorized.Error())
+	assert.Equal(t, http.StatusForbidden, request("bob").Code)
+	assert.Empty(t, socks.Requests())
+	w = request("alice")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "user=", w.Body.String())
+
+	// clients connecting directly can not name a user
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.Host = fmt.Sprintf("%s.%s", testOnionID, domain)
+	r.Header.Set("X-Forwarded-User", "alice")
+	w = httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Len(t, socks.Requests(), 1)
+
+	// an invalid file keeps the current keys
+	require.Nil(t, os.WriteFile(app.clientAuthPath, []byte("invalid\n"), 0o600))
+	app.reload()
+	assert.Equal(t, http.StatusForbidden, request("bob").Code)
+	assert.Len(t, control.ClientAuth(), 2)
+
+	// removed keys are removed from TOR and changed keys are replaced
+	require.Nil(t, os.WriteFile(app.clientAuthPath, []byte(fmt.Sprintf("%s:descriptor:x25519:%s alice,bob\n", testOnionID, testClientAuthKey('c'))), 0o600))
+	app.reload()
+	assert.Equal(t, map[string]string{
+		testOnionID: "x25519:" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat("c", 32))),
+	}, control.ClientAuth())
+	assert.Equal(t, http.StatusOK, request("bob").Code)
+}
+
+func TestLoadClientAuthControlError(t *testing.T) {
+	t.Parallel()
+
+	app := newTestApplication(t, "onion.zwiebel", "socks5://127.0.0.1:9050")
+	app.control = newTorControl(closedAddress(t), "", "", time.Second)
+	app.clientAuthPath = filepath.Join(t.TempDir(), "client_auth")
+	require.Nil(t, os.WriteFile(app.clientAuthPath, []byte(fmt.Sprintf("%s:descriptor:x25519:%s alice\n", testOnionID, testClientAuthKey('a'))), 0o600))
+
+	err := app.loadClientAuth(context.Background())
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "could not add the client authorization key of "+testOnionID)
+	// the users are still enforced
+	assert.False(t, app.clientAuth.Load().authorized(newOnionTarget(testOnionID, ""), ""))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// parsePrefixes parses a comma separated list of networks in CIDR notation.
+// Single addresses are treated as a network containing only this address.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q: %w", entry, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", entry, err)
+		}
+		if prefix.Addr().Is4In6() {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsAddr reports if addr is part of one of the networks
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddr parses an ip address with an optional port
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// clientAddr returns the address of the client set by the realIPMiddleware
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	return parseAddr(r.RemoteAddr)
+}
+
+// forwardedElement is one proxy hop of the Forwarded header
+type forwardedElement struct {
+	For   string
+	Proto string
+	Host  string
+}
+
+// parseForwarded parses the Forwarded header, unknown parameters and
+// invalid pairs are skipped.
+// https://www.rfc-editor.org/rfc/rfc7239#section-4
+func parseForwarded(values []string) []forwardedElement {
+	var elements []forwardedElement
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			var e forwardedElement
+			for _, pair := range splitQuoted(element, ';') {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				val = strings.TrimSpace(val)
+				if len(val) >= 2 && strings.HasPrefix(val, `"`) && strings.HasSuffix(val, `"`) {
+					val = strings.ReplaceAll(val[1:len(val)-1], `\"`, `"`)
+				}
+				switch strings.ToLower(strings.TrimSpace(key)) {
+				case "for":
+					e.For = val
+				case "proto":
+					e.Proto = strings.ToLower(val)
+				case "host":
+					e.Host = val
+				}
+			}
+			elements = append(elements, e)
+		}
+	}
+	return elements
+}
+
+// splitQuoted splits s at sep outside of quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// realIP returns the client address sent by a trusted reverse proxy. The
+// Forwarded and X-Forwarded-For headers are read from the right so addresses
+// added by the client itself are skipped. Forwarded is only used if enabled
+// and True-Client-IP is ignored as most reverse proxies pass these headers
+// on unchanged.
+func (app *application) realIP(r *http.Request) (netip.Addr, bool) {
+	var hops []string
+	if forwarded := r.Header.Values("Forwarded"); app.trustForwarded && len(forwarded) > 0 {
+		for _, element := range parseForwarded(forwarded) {
+			hops = append(hops, element.For)
+		}
+	} else {
+		if value := r.Header.Get("X-Real-IP"); value != "" {
+			return parseAddr(value)
+		}
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	}
+
+	var addr netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, ok := parseAddr(hops[i])
+		if !ok {
+			break
+		}
+		addr = hop
+		if !containsAddr(app.trustedProxies, hop) {
+			break
+		}
+	}
+	return addr, addr.IsValid()
+}
+
+// realIPMiddleware replaces the remote address with the address of the client
+// if the request was sent by a trusted reverse proxy. The headers of all other
+// peers are ignored so clients can not spoof their address.
+func (app *application) realIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if peer, ok := clientAddr(r); ok && containsAddr(app.trustedProxies, peer) {
+			r = withTrustedProxy(r)
+			if addr, ok := app.realIP(r); ok {
+				r.RemoteAddr = addr.String()
+			}
+		} else if app.userHeader != "" {
+			// only the reverse proxy can name the user
+			r.Header.Del(app.userHeader)
+		}
+		r.Header.Del("X-Real-IP")
+		r.Header.Del("True-Client-IP")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrefixes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+		err      bool
+	}{
+		{"empty", "", nil, false},
+		{"networks", "10.0.0.0/8, 2001:db8::/32", []string{"10.0.0.0/8", "2001:db8::/32"}, false},
+		{"single addresses", "192.0.2.1,::1", []string{"192.0.2.1/32", "::1/128"}, false},
+		{"masked", "192.0.2.1/24", []string{"192.0.2.0/24"}, false},
+		{"mapped", "::ffff:192.0.2.0/120", []string{"192.0.2.0/24"}, false},
+		{"invalid address", "192.0.2", nil, true},
+		{"invalid network", "192.0.2.0/33", nil, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			prefixes, err := parsePrefixes(tt.input)
+			if tt.err {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			var got []string
+			for _, prefix := range prefixes {
+				got = append(got, prefix.String())
+			}
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestRealIPMiddleware(t *testing.T) {
+	t.Parallel()
+
+	trusted, err := parsePrefixes("127.0.0.0/8,10.0.0.0/8")
+	require.Nil(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		expected   string
+	}{
+		{"no header", "192.0.2.1:1234", nil, "192.0.2.1:1234"},
+		{"untrusted real ip", "192.0.2.1:1234", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "192.0.2.1:1234"},
+		{"untrusted forwarded for", "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "192.0.2.1:1234"},
+		{"trusted real ip", "127.0.0.1:1234", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"ignored true client ip", "127.0.0.1:1234", http.Header{"True-Client-Ip": {"2001:db8::1"}}, "127.0.0.1:1234"},
+		{"real ip wins over true client ip", "127.0.0.1:1234", http.Header{"True-Client-Ip": {"2001:db8::1"}, "X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"trusted invalid real ip", "127.0.0.1:1234", http.Header{"X-Real-Ip": {"invalid"}}, "127.0.0.1:1234"},
+		{"trusted forwarded for", "127.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"spoofed forwarded for", "127.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.1, 198.51.100.1"}}, "198.51.100.1"},
+		{"trusted hops", "127.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.1, 198.51.100.1", "10.0.0.1"}}, "198.51.100.1"},
+		{"only trusted hops", "127.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.2, 10.0.0.1"}}, "10.0.0.2"},
+		{"trusted ipv6 peer", "[::ffff:127.0.0.1]:1234", http.Header{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"untrusted forwarded", "192.0.2.1:1234", http.Header{"Forwarded": {"for=198.51.100.1"}}, "192.0.2.1:1234"},
+		{"trusted forwarded", "127.0.0.1:1234", http.Header{"Forwarded": {"for=198.51.100.1;proto=https"}}, "198.51.100.1"},
+		{"trusted forwarded ipv6", "127.0.0.1:1234", http.Header{"Forwarded": {`for="[2001:db8::1]:4711"`}}, "2001:db8::1"},
+		{"spoofed forwarded", "127.0.0.1:1234", http.Header{"Forwarded": {"for=203.0.113.1, for=198.51.100.1", "for=10.0.0.1"}}, "198.51.100.1"},
+		{"forwarded wins", "127.0.0.1:1234", http.Header{"Forwarded": {"for=198.51.100.1"}, "X-Real-Ip": {"203.0.113.1"}}, "198.51.100.1"},
+		{"obfuscated forwarded", "127.0.0.1:1234", http.Header{"Forwarded": {"for=_hidden"}}, "127.0.0.1:1234"},
+	}
+
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			app := newTestApplication(t, "onion.zwiebel", "socks5://127.0.0.1:9050")
+			app.trustedProxies = trusted
+			app.trustForwarded = true
+			var got string
+			handler := app.realIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.RemoteAddr
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			assert.Equal(t, tt.expected, got)
+		})
+	}
+}
+
+func TestParseAddr(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input    string
+		expected string
+		ok       bool
+	}{
+		{"192.0.2.1", "192.0.2.1", true},
+		{"192.0.2.1:80", "192.0.2.1", true},
+		{"[2001:db8::1]:80", "2001:db8::1", true},
+		{"[2001:db8::1]", "2001:db8::1", true},
+		{"::ffff:192.0.2.1", "192.0.2.1", true},
+		{"fe80::1%eth0", "fe80::1", true},
+		{"invalid", "", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.input, func(t *testing.T) {
+			t.Parallel()
+			addr, ok := parseAddr(tt.input)
+			assert.Equal(t, tt.ok, ok)
+			if tt.ok {
+				assert.Equal(t, netip.MustParseAddr(tt.expected), addr)
+			}
+		})
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    []string
+		expected []forwardedElement
+	}{
+		{"empty", nil, nil},
+		{"single", []string{"for=192.0.2.60;proto=http;by=203.0.113.43"}, []forwardedElement{{For: "192.0.2.60", Proto: "http"}}},
+		{"case insensitive", []string{"For=192.0.2.60;PROTO=HTTPS;Host=onion.zwiebel"}, []forwardedElement{{For: "192.0.2.60", Proto: "https", Host: "onion.zwiebel"}}},
+		{"quoted", []string{`for="[2001:db8:cafe::17]:4711";host="a;b,c"`}, []forwardedElement{{For: "[2001:db8:cafe::17]:4711", Host: "a;b,c"}}},
+		{"multiple elements", []string{"for=192.0.2.43, for=198.51.100.17"}, []forwardedElement{{For: "192.0.2.43"}, {For: "198.51.100.17"}}},
+		{"multiple headers", []string{"for=192.0.2.43", "for=198.51.100.17;proto=https"}, []forwardedElement{{For: "192.0.2.43"}, {For: "198.51.100.17", Proto: "https"}}},
+		{"invalid pair", []string{"invalid;for=192.0.2.43"}, []forwardedElement{{For: "192.0.2.43"}}},
+	}
+
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tt.expected, parseForwarded(tt.input))
+		})
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	t.Parallel()
+
+	trusted, err := parsePrefixes("127.0.0.0/8")
+	require.Nil(t, err)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		host       string
+		scheme     string
+	}{
+		{"untrusted proto", "192.0.2.1:1234", http.Header{"X-Forwarded-Proto": {"https"}}, "onion.zwiebel", "http"},
+		{"untrusted port", "192.0.2.1:1234", http.Header{"X-Forwarded-Port": {"8443"}}, "onion.zwiebel", "http"},
+		{"untrusted forwarded", "192.0.2.1:1234", http.Header{"Forwarded": {"proto=https;host=evil.example"}}, "onion.zwiebel", "http"},
+		{"trusted proto", "127.0.0.1:1234", http.Header{"X-Forwarded-Proto": {"https"}}, "onion.zwiebel", "https"},
+		{"trusted invalid proto", "127.0.0.1:1234", http.Header{"X-Forwarded-Proto": {"javascript"}}, "onion.zwiebel", "http"},
+		{"trusted port", "127.0.0.1:1234", http.Header{"X-Forwarded-Port": {"8443"}}, "onion.zwiebel:8443", "http"},
+		{"trusted default port", "127.0.0.1:1234", http.Header{"X-Forwarded-Port": {"443"}}, "onion.zwiebel", "http"},
+		{"trusted forwarded", "127.0.0.1:1234", http.Header{"Forwarded": {"for=192.0.2.1;proto=https;host=sub.onion.zwiebel"}}, "sub.onion.zwiebel", "https"},
+		{"trusted forwarded last element", "127.0.0.1:1234", http.Header{"Forwarded": {"proto=http;host=evil.example, proto=https"}}, "onion.zwiebel", "https"},
+		{"trusted forwarded wins", "127.0.0.1:1234", http.Header{"Forwarded": {"proto=https"}, "X-Forwarded-Proto": {"http"}}, "onion.zwiebel", "https"},
+		{"trusted forwarded invalid host", "127.0.0.1:1234", http.Header{"Forwarded": {`host="evil.example/path"`}}, "onion.zwiebel", "http"},
+	}
+
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			app := newTestApplication(t, "onion.zwiebel", "socks5://127.0.0.1:9050")
+			app.trustedProxies = trusted
+			app.trustForwarded = true
+			var got *http.Request
+			handler := app.realIPMiddleware(app.xHeaderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+			})))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = "onion.zwiebel"
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				r.Header[k] = v
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			require.NotNil(t, got)
+			assert.Equal(t, tt.host, got.Host)
+			assert.Equal(t, tt.scheme, clientScheme(got))
+			// the headers are never sent to the onion services
+			for _, header := range []string{"Forwarded", "X-Forwarded-Proto", "X-Forwarded-Port", "X-Real-Ip"} {
+				assert.Empty(t, got.Header.Get(header), header)
+			}
+		})
+	}
+}
+
+func TestForwardedDisabled(t *testing.T) {
+	t.Parallel()
+
+	app := newTestApplication(t, "onion.zwiebel", "socks5://127.0.0.1:9050")
+	app.trustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	var got *http.Request
+	handler := app.realIPMiddleware(app.xHeaderMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	})))
+	// the reverse proxy passed on the header of the client
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "onion.zwiebel"
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("Forwarded", "for=203.0.113.1;proto=https;host=evil.example")
+	r.Header.Set("X-Real-Ip", "198.51.100.1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	require.NotNil(t, got)
+	assert.Equal(t, "198.51.100.1", got.RemoteAddr)
+	assert.Equal(t, "onion.zwiebel", got.Host)
+	assert.Equal(t, "http", clientScheme(got))
+	assert.Empty(t, got.Header.Get("Forwarded"))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type contextKey int
+
+const (
+	contextKeyClientScheme contextKey = iota
+	contextKeyRequestDeadline
+	contextKeyOnionTarget
+	contextKeyPathRoute
+	contextKeyProxyDomain
+	contextKeyCircuit
+	contextKeyUser
+	contextKeyTrustedProxy
+)
+
+// clientScheme returns the scheme the client used to connect to us. It is
+// set in the xHeaderMiddleware and defaults to http.
+func clientScheme(r *http.Request) string {
+	if scheme, ok := r.Context().Value(contextKeyClientScheme).(string); ok && scheme != "" {
+		return scheme
+	}
+	return "http"
+}
+
+func withClientScheme(r *http.Request, scheme string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKeyClientScheme, scheme))
+}
+
+// requestDeadlineFromRequest returns the deadline set in the proxyHandler or nil
+func requestDeadlineFromRequest(r *http.Request) *requestDeadline {
+	if d, ok := r.Context().Value(contextKeyRequestDeadline).(*requestDeadline); ok {
+		return d
+	}
+	return nil
+}
+
+func withRequestDeadline(r *http.Request, d *requestDeadline) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKeyRequestDeadline, d))
+}
+
+// onionTargetFromRequest returns the target parsed in the proxyHandler
+func onionTargetFromRequest(r *http.Request) (onionTarget, bool) {
+	target, ok := r.Context().Value(contextKeyOnionTarget).(onionTarget)
+	return target, ok
+}
+
+func withOnionTarget(r *http.Request, target onionTarget) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKeyOnionTarget, target))
+}
+
+// pathRouteFromRequest returns the route of requests proxied in path mode
+func pathRouteFromRequest(r *http.Request) (pathRoute, bool) {
+	route, ok := r.Context().Value(contextKeyPathRoute).(pathRoute)
+	return route, ok
+}
+
+func withPathRoute(r *http.Request, route pathRoute) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKeyPathRoute, route))
+}
+
+// proxyDomainFromRequest returns the proxy domain matched in the proxyHandler
+func proxyDomainFromRequest(r *http.Request) (string, bool) {
+	domain, ok := r.Context().Value(contextKeyProxyDomain).(string)
+	return domain, ok
+}
+
+func withProxyDomain(r *http.Request, domain string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKeyProxyDomain, domain))
+}
+
+// circuitFromRequest returns the circuit set for a retry
+func circuitFromRequest(r *http.Request) (string, bool) {
+	circuit, ok := r.Context().Value(contextKeyCircuit).(string)
+	return circuit, ok
+}
+
+func withCircuit(r *http.Request, circuit string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKeyCircuit, circuit))
+}
+
+// userFromRequest returns the user authenticated in the authMiddleware
+func userFromRequest(r *http.Request) (string, bool) {
+	user, ok := r.Context().Value(contextKeyUser).(string)
+	return user, ok
+}
+
+func withUser(r *http.Request, user string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKeyUser, user))
+}
+
+// fromTrustedProxy reports if the request was sent by a trusted reverse
+// proxy. It is set in the realIPMiddleware.
+func fromTrustedProxy(r *http.Request) bool {
+	trusted, _ := r.Context().Value(contextKeyTrustedProxy).(bool)
+	return trusted
+}
+
+func withTrustedProxy(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), contextKeyTrustedProxy, true))
+}
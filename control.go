@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// statusPath reports the health of TOR on the proxy domain
+	statusPath = "/status"
+	// newnymPath requests new TOR circuits on the proxy domain
+	newnymPath = "/admin/newnym"
+	// newnymInterval is the minimum time between two NEWNYM signals, TOR
+	// delays more frequent signals anyway
+	newnymInterval = 10 * time.Second
+)
+
+var errNewnymRateLimited = errors.New("new circuits were requested less than 10 seconds ago")
+
+// torControl talks to the control port of TOR. Every command uses a new
+// connection so a restarted daemon does not need any special handling.
+// https://spec.torproject.org/control-spec/
+type torControl struct {
+	address    string
+	password   string
+	cookiePath string
+	timeout    time.Duration
+
+	mu         sync.Mutex
+	lastNewnym time.Time
+}
+
+// torBootstrap is the bootstrap progress of TOR
+type torBootstrap struct {
+	Progress int    `json:"progress"`
+	Tag      string `json:"tag"`
+	Summary  string `json:"summary"`
+}
+
+var controlKeywordRegex = regexp.MustCompile(`([A-Z]+)=("(?:[^"\\]|\\.)*"|\S+)`)
+
+func newTorControl(address, password, cookiePath string, timeout time.Duration) *torControl {
+	return &torControl{
+		address:    address,
+		password:   password,
+		cookiePath: cookiePath,
+		timeout:    timeout,
+	}
+}
+
+// bootstrap returns the current bootstrap phase
+func (c *torControl) bootstrap(ctx context.Context) (torBootstrap, error) {
+	lines, err := c.command(ctx, "GETINFO status/bootstrap-phase")
+	if err != nil {
+		return torBootstrap{}, err
+	}
+	for _, line := range lines {
+		value, ok := strings.CutPrefix(line, "status/bootstrap-phase=")
+		if !ok {
+			continue
+		}
+		var status torBootstrap
+		for key, val := range parseControlKeywords(value) {
+			switch key {
+			case "PROGRESS":
+				status.Progress, err = strconv.Atoi(val)
+				if err != nil {
+					return torBootstrap{}, fmt.Errorf("invalid bootstrap progress %q", val)
+				}
+			case "TAG":
+				status.Tag = val
+			case "SUMMARY":
+				status.Summary = val
+			}
+		}
+		return status, nil
+	}
+	return torBootstrap{}, fmt.Errorf("no bootstrap phase in reply %q", strings.Join(lines, " "))
+}
+
+// newnym asks TOR to use new circuits for new connections
+func (c *torControl) newnym(ctx context.Context) error {
+	c.mu.Lock()
+	if time.Since(c.lastNewnym) < newnymInterval {
+		c.mu.Unlock()
+		return errNewnymRateLimited
+	}
+	last := c.lastNewnym
+	c.lastNewnym = time.Now()
+	c.mu.Unlock()
+
+	if _, err := c.command(ctx, "SIGNAL NEWNYM"); err != nil {
+		// the signal did not arrive so allow a retry
+		c.mu.Lock()
+		c.lastNewnym = last
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// command authenticates, sends cmd and returns the lines of the reply
+// without the status code
+func (c *torControl) command(ctx context.Context, cmd string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to the TOR control port: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	r := bufio.NewReader(conn)
+	send := func(line string) ([]string, error) {
+		if _, err := fmt.Fprintf(conn, "%s\r\n", line); err != nil {
+			return nil, err
+		}
+		return readControlReply(r)
+	}
+
+	auth, err := c.authenticateCommand(send)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := send(auth); err != nil {
+		return nil, fmt.Errorf("could not authenticate to the TOR control port: %w", err)
+	}
+	lines, err := send(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w", strings.Fields(cmd)[0], err)
+	}
+	_, _ = send("QUIT")
+	return lines, nil
+}
+
+// authenticateCommand returns the AUTHENTICATE command. Without a configured
+// password or cookie file the methods offered by TOR are used.
+// https://spec.torproject.org/control-spec/commands.html#authenticate
+func (c *torControl) authenticateCommand(send func(string) ([]string, error)) (string, error) {
+	if c.password != "" {
+		return fmt.Sprintf("AUTHENTICATE %s", quoteControlString(c.password)), nil
+	}
+
+	cookiePath := c.cookiePath
+	if cookiePath == "" {
+		lines, err := send("PROTOCOLINFO 1")
+		if err != nil {
+			return "", fmt.Errorf("PROTOCOLINFO failed: %w", err)
+		}
+		methods := ""
+		for _, line := range lines {
+			if rest, ok := strings.CutPrefix(line, "AUTH "); ok {
+				keywords := parseControlKeywords(rest)
+				methods = keywords["METHODS"]
+				cookiePath = keywords["COOKIEFILE"]
+			}
+		}
+		if !strings.Contains(methods, "COOKIE") {
+			cookiePath = ""
+		}
+		if cookiePath == "" {
+			if strings.Contains(methods, "NULL") {
+				return "AUTHENTICATE", nil
+			}
+			return "", fmt.Errorf("TOR control port requires one of the authentication methods %s, please configure a password or a cookie file", methods)
+		}
+	}
+
+	cookie, err := os.ReadFile(cookiePath)
+	if err != nil {
+		return "", fmt.Errorf("could not read the TOR control cookie: %w", err)
+	}
+	return fmt.Sprintf("AUTHENTICATE %s", hex.EncodeToString(cookie)), nil
+}
+
+// readControlReply reads a reply until the end line. Replies with a status
+// code other than 2xx are returned as error.
+// https://spec.torproject.org/control-spec/protocol-outline.html
+func readControlReply(r *bufio.Reader) ([]string, error) {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, fmt.Errorf("invalid reply line %q", line)
+		}
+		code, separator, text := line[:3], line[3], line[4:]
+		if code[0] != '2' {
+			return nil, fmt.Errorf("%s %s", code, text)
+		}
+		lines = append(lines, text)
+		switch separator {
+		case ' ':
+			return lines, nil
+		case '+':
+			// data lines until a single dot
+			for {
+				data, err := r.ReadString('\n')
+				if err != nil {
+					return nil, err
+				}
+				data = strings.TrimRight(data, "\r\n")
+				if data == "." {
+					break
+				}
+				lines = append(lines, strings.TrimPrefix(data, "."))
+			}
+		}
+	}
+}
+
+// parseControlKeywords parses KEY=value pairs, quoted values are unquoted
+func parseControlKeywords(s string) map[string]string {
+	keywords := make(map[string]string)
+	for _, m := range controlKeywordRegex.FindAllStringSubmatch(s, -1) {
+		value := m[2]
+		if strings.HasPrefix(value, `"`) {
+			if unquoted, err := strconv.Unquote(value); err == nil {
+				value = unquoted
+			} else {
+				value = strings.Trim(value, `"`)
+			}
+		}
+		keywords[m[1]] = value
+	}
+	return keywords
+}
+
+func quoteControlString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return fmt.Sprintf(`"%s"`, s)
+}
+
+// requestNewnym sends NEWNYM and logs the result
+func (app *application) requestNewnym(ctx context.Context, reason string) error {
+	err := app.control.newnym(ctx)
+	if err != nil {
+		app.logger.Errorf("could not request new TOR circuits (%s): %v", reason, err)
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("could not request new TOR circuits (%s): %v", reason, err)
+			app.JsonLogger.ErrorLevel(message)
+		}
+		return err
+	}
+	app.logger.Infof("requested new TOR circuits (%s)", reason)
+	if app.JsonLoggerEnabled {
+		message := fmt.Sprintf("requested new TOR circuits (%s)", reason)
+		app.JsonLogger.DebugLevel(message)
+	}
+	return nil
+}
+
+// isTorFailure reports if a request failed because of TOR or its circuits.
+// Canceled requests, timeouts and errors of single onion services are not
+// fixed by new circuits.
+func isTorFailure(err error) bool {
+	if se, ok := parseSOCKSError(err); ok {
+		return se.circuitFailure()
+	}
+	return isTorDialError(err)
+}
+
+// recordProxyResult counts consecutive TOR failures and requests new
+// circuits once the configured threshold is reached
+func (app *application) recordProxyResult(err error) {
+	if err == nil {
+		app.failures.Store(0)
+		return
+	}
+	if !isTorFailure(err) || app.control == nil || app.newnymFailures <= 0 {
+		return
+	}
+	if app.failures.Add(1) < int64(app.newnymFailures) {
+		return
+	}
+	app.failures.Store(0)
+	go func() {
+		_ = app.requestNewnym(context.Background(), fmt.Sprintf("%d failed requests", app.newnymFailures))
+	}()
+}
+
+// bootstrapState is the result of the last bootstrap poll
+type bootstrapState struct {
+	bootstrap torBootstrap
+	err       error
+}
+
+// checkTorBootstrap polls the bootstrap state of TOR so the status endpoint
+// does not open a control connection on every request
+func (app *application) checkTorBootstrap(ctx context.Context) {
+	bootstrap, err := app.control.bootstrap(ctx)
+	if err != nil {
+		app.logger.Debugf("could not get the bootstrap status of TOR: %v", err)
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("could not get the bootstrap status of TOR: %v", err)
+			app.JsonLogger.DebugLevel(message)
+		}
+	}
+	app.bootstrap.Store(&bootstrapState{bootstrap: bootstrap, err: err})
+}
+
+// torStatus is returned by the status endpoint. The details are only shown
+// with the admin token.
+type torStatus struct {
+	Status    string             `json:"status"`
+	Backends  []torBackendStatus `json:"backends,omitempty"`
+	Bootstrap *torBootstrap      `json:"bootstrap,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+type torBackendStatus struct {
+	Address string `json:"address"`
+	Healthy bool   `json:"healthy"`
+}
+
+// adminAuthorized reports if the request carries the admin token
+func (app *application) adminAuthorized(r *http.Request) bool {
+	if app.adminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(app.adminToken)) == 1
+}
+
+// statusHandler reports if TOR is ready. The status code is 503 until TOR is
+// fully bootstrapped and at least one backend is healthy so it can be used by
+// health checks. The backends and the bootstrap progress are only returned
+// with the admin token.
+func (app *application) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.proxyHost(r); !ok {
+		app.proxyHandler(w, r)
+		return
+	}
+
+	status := torStatus{}
+	ready := true
+	if app.tor != nil {
+		healthy := 0
+		for _, b := range app.tor.backends {
+			status.Backends = append(status.Backends, torBackendStatus{Address: b.address, Healthy: b.healthy.Load()})
+			if b.healthy.Load() {
+				healthy++
+			}
+		}
+		if healthy == 0 {
+			ready = false
+		}
+	}
+	if app.control != nil {
+		state := app.bootstrap.Load()
+		switch {
+		case state == nil:
+			status.Error = "bootstrap status not polled yet"
+			ready = false
+		case state.err != nil:
+			status.Error = state.err.Error()
+			ready = false
+		default:
+			bootstrap := state.bootstrap
+			status.Bootstrap = &bootstrap
+			if bootstrap.Progress < 100 {
+				ready = false
+			}
+		}
+	}
+
+	statusCode := http.StatusOK
+	status.Status = "healthy"
+	if !ready {
+		statusCode = http.StatusServiceUnavailable
+		status.Status = "not ready"
+	}
+	if !app.adminAuthorized(r) {
+		status = torStatus{Status: status.Status}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		app.logger.Error(err)
+		if app.JsonLoggerEnabled {
+			app.JsonLogger.ErrorLevel(err.Error())
+		}
+	}
+}
+
+// newnymHandler requests new circuits, it needs the admin token
+func (app *application) newnymHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.proxyHost(r); !ok {
+		app.proxyHandler(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if !app.adminAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if err := app.requestNewnym(r.Context(), "admin request"); err != nil {
+		statusCode := http.StatusBadGateway
+		if errors.Is(err, errNewnymRateLimited) {
+			statusCode = http.StatusTooManyRequests
+		}
+		http.Error(w, err.Error(), statusCode)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
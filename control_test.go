@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeControlServer is a minimal TOR control port
+// https://spec.torproject.org/control-spec/
+type fakeControlServer struct {
+	listener   net.Listener
+	password   string
+	cookie     []byte
+	cookiePath string
+
+	mu       sync.Mutex
+	progress int
+	newnyms  int
+	// clientAuth holds the added client authorization keys by service id
+	clientAuth map[string]string
+}
+
+// newFakeControlServer returns a control port accepting the password or the
+// cookie in cookiePath. Without both NULL authentication is used.
+func newFakeControlServer(t *testing.T, password string, cookie []byte) *fakeControlServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := &fakeControlServer{
+		listener:   listener,
+		password:   password,
+		cookie:     cookie,
+		progress:   100,
+		clientAuth: make(map[string]string),
+	}
+	if cookie != nil {
+		s.cookiePath = filepath.Join(t.TempDir(), "control_auth_cookie")
+		require.Nil(t, os.WriteFile(s.cookiePath, cookie, 0o600))
+	}
+	t.Cleanup(func() {
+		s.listener.Close()
+	})
+	go s.serve()
+	return s
+}
+
+func (s *fakeControlServer) setProgress(progress int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.progress = progress
+}
+
+func (s *fakeControlServer) Newnyms() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newnyms
+}
+
+func (s *fakeControlServer) ClientAuth() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make(map[string]string, len(s.clientAuth))
+	for id, key := range s.clientAuth {
+		keys[id] = key
+	}
+	return keys
+}
+
+func (s *fakeControlServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeControlServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	authenticated := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		var reply string
+		switch {
+		case command == "PROTOCOLINFO":
+			methods := "NULL"
+			switch {
+			case s.cookie != nil:
+				methods = fmt.Sprintf(`COOKIE,SAFECOOKIE COOKIEFILE="%s"`, s.cookiePath)
+			case s.password != "":
+				methods = "HASHEDPASSWORD"
+			}
+			reply = fmt.Sprintf("250-PROTOCOLINFO 1\r\n250-AUTH METHODS=%s\r\n250-VERSION Tor=\"0.4.8.9\"\r\n250 OK\r\n", methods)
+		case command == "AUTHENTICATE":
+			switch {
+			case s.password != "" && arg == quoteControlString(s.password),
+				s.cookie != nil && arg == hex.EncodeToString(s.cookie),
+				s.password == "" && s.cookie == nil:
+				authenticated = true
+				reply = "250 OK\r\n"
+			default:
+				reply = "515 Authentication failed: Password did not match HashedControlPassword value from configuration\r\n"
+			}
+		case command == "QUIT":
+			_, _ = conn.Write([]byte("250 closing connection\r\n"))
+			return
+		case !authenticated:
+			reply = "514 Authentication required.\r\n"
+		case command == "GETINFO" && arg == "status/bootstrap-phase":
+			s.mu.Lock()
+			progress := s.progress
+			s.mu.Unlock()
+			tag, summary := "done", "Done"
+			if progress < 100 {
+				tag, summary = "loading_descriptors", "Loading relay descriptors"
+			}
+			reply = fmt.Sprintf("250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=%d TAG=%s SUMMARY=\"%s\"\r\n250 OK\r\n", progress, tag, summary)
+		case command == "SIGNAL" && arg == "NEWNYM":
+			s.mu.Lock()
+			s.newnyms++
+			s.mu.Unlock()
+			reply = "250 OK\r\n"
+		case command == "ONION_CLIENT_AUTH_ADD":
+			args := strings.Fields(arg)
+			s.mu.Lock()
+			_, existed := s.clientAuth[args[0]]
+			s.clientAuth[args[0]] = args[1]
+			s.mu.Unlock()
+			reply = "250 OK\r\n"
+			if existed {
+				reply = "251 Client for onion existed and replaced\r\n"
+			}
+		case command == "ONION_CLIENT_AUTH_REMOVE":
+			s.mu.Lock()
+			_, existed := s.clientAuth[arg]
+			delete(s.clientAuth, arg)
+			s.mu.Unlock()
+			reply = "250 OK\r\n"
+			if !existed {
+				reply = "251 No credentials for \"" + arg + "\"\r\n"
+			}
+		default:
+			reply = fmt.Sprintf("510 Unrecognized command \"%s\"\r\n", command)
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func TestReadControlReply(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+		err      string
+	}{
+		{"single line", "250 OK\r\n", []string{"OK"}, ""},
+		{"multiple lines", "250-version=0.4.8.9\r\n250 OK\r\n", []string{"version=0.4.8.9", "OK"}, ""},
+		{"data", "250+config-text=\r\nSocksPort 9050\r\n..escaped\r\n.\r\n250 OK\r\n", []string{"config-text=", "SocksPort 9050", ".escaped", "OK"}, ""},
+		{"error", "552 Unrecognized key\r\n", nil, "552 Unrecognized key"},
+		{"invalid", "25\r\n", nil, "invalid reply line"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			lines, err := readControlReply(bufio.NewReader(strings.NewReader(tt.input)))
+			if tt.err != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tt.expected, lines)
+		})
+	}
+}
+
+func TestParseControlKeywords(t *testing.T) {
+	t.Parallel()
+
+	keywords := parseControlKeywords(`NOTICE BOOTSTRAP PROGRESS=75 TAG=enough_dirinfo SUMMARY="Loaded \"enough\" directory info"`)
+	assert.Equal(t, map[string]string{
+		"PROGRESS": "75",
+		"TAG":      "enough_dirinfo",
+		"SUMMARY":  `Loaded "enough" directory info`,
+	}, keywords)
+}
+
+func TestTorControlBootstrap(t *testing.T) {
+	t.Parallel()
+
+	cookie := []byte("0123456789abcdef0123456789abcdef")
+	tests := []struct {
+		name           string
+		serverPassword string
+		serverCookie   []byte
+		password       string
+		cookieFile     bool
+		err            string
+	}{
+		{"null", "", nil, "", false, ""},
+		{"password", "secret \"pass\"", nil, "secret \"pass\"", false, ""},
+		{"wrong password", "secret", nil, "wrong", false, "515 Authentication failed"},
+		{"missing password", "secret", nil, "", false, "please configure a password or a cookie file"},
+		{"cookie file", "", cookie, "", true, ""},
+		{"announced cookie file", "", cookie, "", false, ""},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := newFakeControlServer(t, tt.serverPassword, tt.serverCookie)
+			cookiePath := ""
+			if tt.cookieFile {
+				cookiePath = s.cookiePath
+			}
+			c := newTorControl(s.listener.Addr().String(), tt.password, cookiePath, time.Second)
+			status, err := c.bootstrap(context.Background())
+			if tt.err != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, torBootstrap{Progress: 100, Tag: "done", Summary: "Done"}, status)
+		})
+	}
+}
+
+func TestTorControlNewnym(t *testing.T) {
+	t.Parallel()
+
+	s := newFakeControlServer(t, "", nil)
+	c := newTorControl(s.listener.Addr().String(), "", "", time.Second)
+	require.Nil(t, c.newnym(context.Background()))
+	assert.ErrorIs(t, c.newnym(context.Background()), errNewnymRateLimited)
+	assert.Equal(t, 1, s.Newnyms())
+
+	// failed signals can be retried immediately
+	dead := newTorControl(closedAddress(t), "", "", time.Second)
+	assert.NotNil(t, dead.newnym(context.Background()))
+	assert.NotErrorIs(t, dead.newnym(context.Background()), errNewnymRateLimited)
+}
+
+// statusRequest requests the status endpoint with an optional admin token
+func statusRequest(t *testing.T, app *application, token string) (*httptest.ResponseRecorder, torStatus) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, statusPath, nil)
+	r.Host = "onion.zwiebel"
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+	var status torStatus
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	return w, status
+}
+
+func TestStatusHandler(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		progress       int
+		healthy        bool
+		expectedStatus int
+		expected       string
+	}{
+		{"bootstrapped", 100, true, http.StatusOK, "healthy"},
+		{"bootstrapping", 50, true, http.StatusServiceUnavailable, "not ready"},
+		{"no healthy backend", 100, false, http.StatusServiceUnavailable, "not ready"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			control := newFakeControlServer(t, "", nil)
+			control.setProgress(tt.progress)
+			app := newTestPoolApplication(t, "onion.zwiebel", "", "socks5://127.0.0.1:9050")
+			app.tor.backends[0].healthy.Store(tt.healthy)
+			app.control = newTorControl(control.listener.Addr().String(), "", "", time.Second)
+			app.adminToken = "token"
+			app.checkTorBootstrap(context.Background())
+
+			// the public status does not contain any details
+			w, status := statusRequest(t, app, "")
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			assert.Equal(t, torStatus{Status: tt.expected}, status)
+			_, status = statusRequest(t, app, "wrong")
+			assert.Equal(t, torStatus{Status: tt.expected}, status)
+
+			w, status = statusRequest(t, app, "token")
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expected, status.Status)
+			require.NotNil(t, status.Bootstrap)
+			assert.Equal(t, tt.progress, status.Bootstrap.Progress)
+			assert.Equal(t, []torBackendStatus{{Address: "127.0.0.1:9050", Healthy: tt.healthy}}, status.Backends)
+
+			// the bootstrap state is cached
+			control.setProgress(0)
+			_, status = statusRequest(t, app, "token")
+			assert.Equal(t, tt.progress, status.Bootstrap.Progress)
+		})
+	}
+}
+
+func TestStatusHandlerControlError(t *testing.T) {
+	t.Parallel()
+
+	app := newTestPoolApplication(t, "onion.zwiebel", "", "socks5://127.0.0.1:9050")
+	app.tor.backends[0].healthy.Store(true)
+	app.control = newTorControl(closedAddress(t), "", "", time.Second)
+	app.adminToken = "token"
+
+	// not polled yet
+	w, status := statusRequest(t, app, "")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, torStatus{Status: "not ready"}, status)
+
+	// the error of the control port is only shown to admins
+	app.checkTorBootstrap(context.Background())
+	w, status = statusRequest(t, app, "")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, torStatus{Status: "not ready"}, status)
+	_, status = statusRequest(t, app, "token")
+	assert.NotEmpty(t, status.Error)
+}
+
+func TestNewnymHandler(t *testing.T) {
+	t.Parallel()
+
+	control := newFakeControlServer(t, "", nil)
+	app := newTestApplication(t, "onion.zwiebel", "socks5://127.0.0.1:9050")
+	app.control = newTorControl(control.listener.Addr().String(), "", "", time.Second)
+	app.adminToken = "token"
+	handler := app.routes()
+
+	request := func(method, token string) int {
+		r := httptest.NewRequest(method, newnymPath, nil)
+		r.Host = "onion.zwiebel"
+		if token != "" {
+			r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusMethodNotAllowed, request(http.MethodGet, "token"))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, ""))
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "wrong"))
+	assert.Equal(t, 0, control.Newnyms())
+	assert.Equal(t, http.StatusNoContent, request(http.MethodPost, "token"))
+	assert.Equal(t, http.StatusTooManyRequests, request(http.MethodPost, "token"))
+	assert.Equal(t, 1, control.Newnyms())
+}
+
+func TestNewnymOnFailures(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	control := newFakeControlServer(t, "", nil)
+	socks := newFakeSOCKSServer(t, closedAddress(t))
+	// general SOCKS server failure
+	socks.setReply(1)
+	app := newTestApplication(t, domain, socks.URL())
+	app.control = newTorControl(control.listener.Addr().String(), "", "", time.Second)
+	app.newnymFailures = 3
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = fmt.Sprintf("%s.%s", testOnionID, domain)
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, r)
+		assert.Equal(t, http.StatusBadGateway, w.Code)
+	}
+	assert.Equal(t, int64(2), app.failures.Load())
+
+	// a successful response resets the counter
+	app.recordProxyResult(nil)
+	assert.Equal(t, int64(0), app.failures.Load())
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = fmt.Sprintf("%s.%s", testOnionID, domain)
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, r)
+	}
+	assert.Eventually(t, func() bool {
+		return control.Newnyms() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(0), app.failures.Load())
+
+	// errors not caused by TOR are ignored
+	for _, err := range []error{
+		context.Canceled,
+		errRequestTimeout,
+		&socksError{Code: 0xf0},
+		&socksError{Code: 0xf4},
+		&socksError{Code: 0xf6},
+		&socksError{Code: 0x05},
+	} {
+		app.recordProxyResult(err)
+		assert.Equal(t, int64(0), app.failures.Load(), err.Error())
+	}
+}
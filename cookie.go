@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// proxyCookieNames are the cookies of the proxy itself which onion services
+// must not set
+var proxyCookieNames = []string{authCookieName, isolationCookieName, oidcStateCookieName}
+
+// rewriteSetCookie maps the Domain attribute of a Set-Cookie header to our
+// domain, or the Path to the path of the service in path mode, and adjusts
+// Secure and SameSite so the browser accepts the cookie over the scheme the
+// client is using. A Domain not covering host, the onion host that sent the
+// cookie, is removed so services can not set cookies for the proxy or other
+// services. The second return value is false if the cookie must be dropped.
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Set-Cookie
+func rewriteSetCookie(value string, links *linkRewriter, scheme, host string) (string, bool) {
+	cookies := (&http.Response{Header: http.Header{"Set-Cookie": {value}}}).Cookies()
+	if len(cookies) != 1 {
+		// not parseable, only remove the Domain attribute
+		return sanitizeRawSetCookie(value)
+	}
+	cookie := cookies[0]
+	if sliceContains(proxyCookieNames, cookie.Name) {
+		return "", false
+	}
+
+	if links.path != nil {
+		// all services share the host of the proxy in path mode so the
+		// cookie is limited to the path of the service
+		cookie.Domain = ""
+		if strings.HasPrefix(cookie.Path, "/") {
+			cookie.Path = links.path.Prefix + cookie.Path
+		}
+	} else if cookie.Domain != "" {
+		onion := strings.TrimPrefix(cookie.Domain, ".")
+		host, parent := strings.ToLower(host), strings.ToLower(onion)
+		domain, ok := links.rewriteHost(onion)
+		if ok && (host == parent || strings.HasSuffix(host, "."+parent)) {
+			cookie.Domain = domain
+		} else {
+			cookie.Domain = ""
+		}
+	}
+
+	secure := strings.EqualFold(scheme, "https")
+	if !secure {
+		// secure cookies are rejected on plain http
+		cookie.Secure = false
+		// SameSite=None requires the Secure flag so fall back to the browser default
+		if cookie.SameSite == http.SameSiteNoneMode {
+			cookie.SameSite = http.SameSiteLaxMode
+		}
+	} else if cookie.SameSite == http.SameSiteNoneMode {
+		cookie.Secure = true
+	}
+
+	rewritten := cookie.String()
+	if rewritten == "" {
+		return sanitizeRawSetCookie(value)
+	}
+	for _, attr := range cookie.Unparsed {
+		rewritten = rewritten + "; " + attr
+	}
+	return rewritten, true
+}
+
+// sanitizeRawSetCookie removes the Domain attribute of a Set-Cookie header
+// net/http can not parse, browsers may still accept it
+func sanitizeRawSetCookie(value string) (string, bool) {
+	parts := strings.Split(value, ";")
+	name, _, _ := strings.Cut(parts[0], "=")
+	if sliceContains(proxyCookieNames, strings.TrimSpace(name)) {
+		return "", false
+	}
+	kept := parts[:1]
+	for _, attr := range parts[1:] {
+		key, _, _ := strings.Cut(attr, "=")
+		if strings.EqualFold(strings.TrimSpace(key), "domain") {
+			continue
+		}
+		kept = append(kept, attr)
+	}
+	return strings.Join(kept, ";"), true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewriteSetCookie(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	tests := []struct {
+		name     string
+		cookie   string
+		scheme   string
+		expected string
+	}{
+		{"no domain", "session=abc; Path=/; HttpOnly", "http", "session=abc; Path=/; HttpOnly"},
+		{"domain", "session=abc; Domain=asdf.onion; Path=/", "http", "session=abc; Path=/; Domain=asdf.xxx.zwiebel"},
+		{"leading dot", "session=abc; Domain=.asdf.onion; Path=/", "http", "session=abc; Path=/; Domain=asdf.xxx.zwiebel"},
+		{"uppercase", "session=abc; domain=.ASDF.ONION", "http", "session=abc; Domain=ASDF.xxx.zwiebel"},
+		{"other domain", "session=abc; Domain=example.com", "http", "session=abc"},
+		{"proxy domain", "session=abc; Domain=.xxx.zwiebel; Path=/", "http", "session=abc; Path=/"},
+		{"other onion", "session=abc; Domain=qwer.onion", "http", "session=abc"},
+		{"subdomain of host", "session=abc; Domain=api.asdf.onion", "http", "session=abc"},
+		{"onion tld", "session=abc; Domain=.onion", "http", "session=abc"},
+		{"secure over http", "session=abc; Domain=asdf.onion; Secure; HttpOnly", "http", "session=abc; Domain=asdf.xxx.zwiebel; HttpOnly"},
+		{"secure over https", "session=abc; Domain=asdf.onion; Secure; HttpOnly", "https", "session=abc; Domain=asdf.xxx.zwiebel; HttpOnly; Secure"},
+		{"samesite none over http", "session=abc; Secure; SameSite=None", "http", "session=abc; SameSite=Lax"},
+		{"samesite none over https", "session=abc; SameSite=None", "https", "session=abc; Secure; SameSite=None"},
+		{"samesite strict", "session=abc; SameSite=Strict", "http", "session=abc; SameSite=Strict"},
+		{"expires", "session=abc; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "http", "session=abc; Expires=Wed, 21 Oct 2015 07:28:00 GMT"},
+		{"max age", "session=abc; Max-Age=3600", "http", "session=abc; Max-Age=3600"},
+		{"unparsed attributes", "session=abc; Priority=High", "http", "session=abc; Priority=High"},
+		{"invalid", "=; Domain=asdf.onion", "http", "="},
+		{"unparseable", `pref={"a":1}; Domain=xxx.zwiebel; Path=/`, "http", `pref={"a":1}; Path=/`},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			res, ok := rewriteSetCookie(tt.cookie, newLinkRewriter(domain), tt.scheme, "asdf.onion")
+			assert.True(t, ok)
+			assert.Equal(t, tt.expected, res)
+		})
+	}
+
+	// a subdomain can set cookies for its parent
+	res, ok := rewriteSetCookie("session=abc; Domain=asdf.onion", newLinkRewriter(domain), "http", "api.asdf.onion")
+	assert.True(t, ok)
+	assert.Equal(t, "session=abc; Domain=asdf.xxx.zwiebel", res)
+}
+
+func TestRewriteSetCookieProxyCookies(t *testing.T) {
+	t.Parallel()
+
+	for _, cookie := range []string{
+		"zwiebelproxy_auth=abc; Domain=xxx.zwiebel; Path=/",
+		"zwiebelproxy_session=abc",
+		"zwiebelproxy_oidc=abc; Path=/oidc/callback",
+		`zwiebelproxy_auth="{x}"; Domain=xxx.zwiebel`,
+		` zwiebelproxy_auth={"a":1}`,
+	} {
+		_, ok := rewriteSetCookie(cookie, newLinkRewriter("xxx.zwiebel"), "http", "asdf.onion")
+		assert.False(t, ok, cookie)
+	}
+}
+
+func TestModifyResponseSetCookie(t *testing.T) {
+	t.Parallel()
+
+	r, err := http.NewRequest(http.MethodGet, "http://asdf.onion/", nil)
+	require.Nil(t, err)
+	r = withClientScheme(r, "https")
+
+	resp := http.Response{
+		StatusCode: 200,
+		Request:    r,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(bytes.NewBuffer(nil)),
+	}
+	resp.Header.Add("Set-Cookie", "a=1; Domain=.asdf.onion; SameSite=None")
+	resp.Header.Add("Set-Cookie", "b=2; Path=/")
+	resp.Header.Add("Set-Cookie", "zwiebelproxy_auth=abc; Domain=xxx.zwiebel")
+	resp.Header.Set("Location", "http://asdf.onion/login")
+
+	app := application{
+		domains: []string{"xxx.zwiebel"},
+		logger:  &DiscardLogger{},
+	}
+	require.Nil(t, app.modifyResponse(&resp))
+	assert.Equal(t, []string{"a=1; Domain=asdf.xxx.zwiebel; Secure; SameSite=None", "b=2; Path=/"}, resp.Header.Values("Set-Cookie"))
+	assert.Equal(t, "http://asdf.xxx.zwiebel/login", resp.Header.Get("Location"))
+	assert.Equal(t, "http", clientScheme(&http.Request{URL: &url.URL{}}))
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// parseDomains splits a comma separated list of domains. Every domain is
+// returned in lower case with a leading dot.
+func parseDomains(s string) []string {
+	var domains []string
+	for _, domain := range strings.Split(s, ",") {
+		domain = strings.ToLower(strings.Trim(strings.TrimSpace(domain), "."))
+		if domain == "" {
+			continue
+		}
+		domains = append(domains, fmt.Sprintf(".%s", domain))
+	}
+	return domains
+}
+
+// matchDomain returns the proxy domain host is part of, host needs to be in
+// lower case and without a port. If multiple domains match the longest one
+// wins so onion.example.com can be served next to example.com.
+func (app *application) matchDomain(host string) (string, bool) {
+	match := ""
+	for _, domain := range app.domains {
+		if !strings.HasPrefix(domain, ".") {
+			domain = fmt.Sprintf(".%s", domain)
+		}
+		if (strings.HasSuffix(host, domain) || host == strings.TrimLeft(domain, ".")) && len(domain) > len(match) {
+			match = domain
+		}
+	}
+	return match, match != ""
+}
+
+// requestDomain returns the proxy domain the client used. Links in the
+// response are rewritten to this domain so every tenant stays on its own.
+func (app *application) requestDomain(r *http.Request) string {
+	if domain, ok := proxyDomainFromRequest(r); ok {
+		return domain
+	}
+	if len(app.domains) == 0 {
+		return ""
+	}
+	domain := app.domains[0]
+	if !strings.HasPrefix(domain, ".") {
+		domain = fmt.Sprintf(".%s", domain)
+	}
+	return domain
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDomains(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{"empty", "", nil},
+		{"single", "onion.example.com", []string{".onion.example.com"}},
+		{"leading dot", ".onion.example.com", []string{".onion.example.com"}},
+		{"multiple", "onion.example.com, ONION.example.net,,", []string{".onion.example.com", ".onion.example.net"}},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.expected, parseDomains(tt.input))
+		})
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	t.Parallel()
+
+	app := application{
+		domains: []string{".example.com", ".onion.example.com", ".onion.example.net"},
+	}
+	tests := []struct {
+		name     string
+		host     string
+		expected string
+	}{
+		{"subdomain", "asdf.onion.example.net", ".onion.example.net"},
+		{"longest match", "asdf.onion.example.com", ".onion.example.com"},
+		{"shorter domain", "asdf.example.com", ".example.com"},
+		{"domain itself", "onion.example.net", ".onion.example.net"},
+		{"other domain", "asdf.example.org", ""},
+		{"suffix without dot", "asdfonion.example.net", ""},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			domain, ok := app.matchDomain(tt.host)
+			assert.Equal(t, tt.expected != "", ok)
+			assert.Equal(t, tt.expected, domain)
+		})
+	}
+}
+
+func TestProxyHandlerMultipleDomains(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		host           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"first domain", fmt.Sprintf("%s.onion.example.com", testOnionID), http.StatusOK, fmt.Sprintf(`<a href="http://%s.onion.example.com/">`, testOnionIDOther)},
+		{"second domain", fmt.Sprintf("%s.onion.example.net", testOnionID), http.StatusOK, fmt.Sprintf(`<a href="http://%s.onion.example.net/">`, testOnionIDOther)},
+		{"unknown domain", fmt.Sprintf("%s.onion.example.org", testOnionID), http.StatusBadRequest, "onion.example.com or .onion.example.net"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				fmt.Fprintf(w, `<a href="http://%s.onion/">%s</a>`, testOnionIDOther, r.Host)
+			}))
+			defer upstream.Close()
+
+			socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+			app := newTestApplication(t, "onion.example.com", socks.URL())
+			app.domains = parseDomains("onion.example.com,onion.example.net")
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			app.routes().ServeHTTP(w, r)
+
+			body, err := io.ReadAll(w.Body)
+			require.Nil(t, err)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Contains(t, string(body), tt.expectedBody)
+			if tt.expectedStatus != http.StatusOK {
+				assert.Empty(t, socks.Requests())
+				return
+			}
+			// the onion service only sees its own host
+			assert.Contains(t, string(body), fmt.Sprintf("%s.onion</a>", testOnionID))
+			require.Len(t, socks.Requests(), 1)
+			assert.Equal(t, fmt.Sprintf("%s.onion", testOnionID), socks.Requests()[0].Host)
+		})
+	}
+}
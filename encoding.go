@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// contentEncoding knows how to unpack and repack a body so it can be rewritten
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Encoding
+type contentEncoding struct {
+	newReader func(io.Reader) (io.ReadCloser, error)
+	newWriter func(io.Writer) (flushWriter, error)
+}
+
+var contentEncodings = map[string]contentEncoding{
+	"gzip": {
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		newWriter: func(w io.Writer) (flushWriter, error) {
+			return gzip.NewWriter(w), nil
+		},
+	},
+	"deflate": {
+		newReader: newDeflateReader,
+		newWriter: func(w io.Writer) (flushWriter, error) {
+			return zlib.NewWriter(w), nil
+		},
+	},
+	"br": {
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(brotli.NewReader(r)), nil
+		},
+		newWriter: func(w io.Writer) (flushWriter, error) {
+			return brotli.NewWriter(w), nil
+		},
+	},
+	"zstd": {
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		newWriter: func(w io.Writer) (flushWriter, error) {
+			return zstd.NewWriter(w)
+		},
+	},
+}
+
+// newDeflateReader handles the zlib wrapped format mandated by the RFC and
+// the raw deflate streams some servers send instead
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// https://www.rfc-editor.org/rfc/rfc1950#section-2.2
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// lookupContentEncoding returns the encoding for the Content-Encoding header.
+// The second return value is false if we are not able to unpack the body.
+func lookupContentEncoding(header string) (*contentEncoding, bool) {
+	header = strings.ToLower(strings.TrimSpace(header))
+	switch header {
+	case "", "identity":
+		return nil, true
+	case "x-gzip":
+		header = "gzip"
+	}
+	enc, ok := contentEncodings[header]
+	if !ok {
+		return nil, false
+	}
+	return &enc, true
+}
+
+// filterAcceptEncoding removes all encodings from the Accept-Encoding header
+// that we are not able to rewrite
+func filterAcceptEncoding(header string) string {
+	var accepted []string
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		name := strings.ToLower(strings.TrimSpace(strings.Split(part, ";")[0]))
+		if name == "" {
+			continue
+		}
+		if _, ok := lookupContentEncoding(name); ok {
+			accepted = append(accepted, part)
+		}
+	}
+	return strings.Join(accepted, ", ")
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"math/rand"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/net/http/httpguts"
 )
 
 func init() {
@@ -43,6 +44,18 @@ func lookupEnvOrBool(log Logger, key string, defaultVal bool) bool {
 	return defaultVal
 }
 
+func lookupEnvOrInt(log Logger, key string, defaultVal int) int {
+	if val, ok := os.LookupEnv(key); ok {
+		v, err := strconv.Atoi(val)
+		if err != nil {
+			log.Errorf("lookupEnvOrInt[%s]: %v", key, err)
+			return defaultVal
+		}
+		return v
+	}
+	return defaultVal
+}
+
 func lookupEnvOrDuration(log Logger, key string, defaultVal time.Duration) time.Duration {
 	if val, ok := os.LookupEnv(key); ok {
 		v, err := time.ParseDuration(val)
@@ -64,28 +77,15 @@ func sliceContains(slice []string, value string) bool {
 	return false
 }
 
+// isUpgradeRequest checks if the client wants to switch protocols, for example
+// to a websocket
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Protocol_upgrade_mechanism
+func isUpgradeRequest(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && httpguts.HeaderValuesContainsToken(r.Header["Connection"], "upgrade")
+}
+
 func sanitizeString(in string) string {
 	escaped := strings.Replace(in, "\n", "", -1)
 	escaped = strings.Replace(escaped, "\r", "", -1)
 	return escaped
 }
-
-func gzipInput(data []byte) ([]byte, error) {
-	var b bytes.Buffer
-	gz := gzip.NewWriter(&b)
-
-	_, err := gz.Write(data)
-	if err != nil {
-		return nil, err
-	}
-
-	if err = gz.Flush(); err != nil {
-		return nil, err
-	}
-
-	if err = gz.Close(); err != nil {
-		return nil, err
-	}
-
-	return b.Bytes(), nil
-}
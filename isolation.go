@@ -0,0 +1,212 @@
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// isolationMode decides which requests share TOR circuits. TOR uses
+// different circuits for different SOCKS credentials if IsolateSOCKSAuth is
+// set on the SocksPort, which is the default.
+// https://2019.www.torproject.org/docs/tor-manual.html.en#SocksPort
+type isolationMode string
+
+const (
+	isolationNone    isolationMode = ""
+	isolationClient  isolationMode = "client"
+	isolationSession isolationMode = "session"
+	isolationOnion   isolationMode = "onion"
+)
+
+// isolationCookieName is the cookie identifying a session in session mode.
+// It is never sent to the onion services.
+const isolationCookieName = "zwiebelproxy_session"
+
+func parseIsolationMode(s string) (isolationMode, error) {
+	switch mode := isolationMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case isolationNone, isolationClient, isolationSession, isolationOnion:
+		return mode, nil
+	default:
+		return isolationNone, fmt.Errorf("invalid isolation mode %q, valid modes are client, session and onion", s)
+	}
+}
+
+// isolationToken returns the token for the circuits the request is sent
+// through. In session mode a session cookie is set if the client did not send
+// one. An empty token means no isolation.
+func (app *application) isolationToken(w http.ResponseWriter, r *http.Request, target onionTarget) string {
+	var key string
+	switch app.isolation {
+	case isolationClient:
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		key = host
+	case isolationSession:
+		if cookie, err := r.Cookie(isolationCookieName); err == nil && cookie.Value != "" {
+			key = cookie.Value
+		} else {
+			key = randomToken()
+			http.SetCookie(w, app.isolationCookie(r, key))
+		}
+	case isolationOnion:
+		key = target.ServiceID
+	default:
+		return ""
+	}
+
+	// the client ip or the session should not end up in the logs of TOR
+	mac := hmac.New(sha256.New, app.isolationSecret)
+	mac.Write([]byte(fmt.Sprintf("%s:%s", app.isolation, key)))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// isolationCookie returns the session cookie, it is valid for all onion
+// services on the proxy domain
+func (app *application) isolationCookie(r *http.Request, value string) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     isolationCookieName,
+		Value:    value,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   strings.EqualFold(clientScheme(r), "https"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if _, ok := pathRouteFromRequest(r); !ok {
+		cookie.Domain = strings.TrimLeft(app.requestDomain(r), ".")
+	}
+	return cookie
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("could not read random bytes: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// removeCookie removes a single cookie from the Cookie header of a request.
+// The other cookies are kept byte for byte, even if net/http considers them
+// invalid.
+func removeCookie(r *http.Request, name string) {
+	values := r.Header.Values("Cookie")
+	if len(values) == 0 {
+		return
+	}
+	var kept []string
+	for _, value := range values {
+		var pairs []string
+		for _, pair := range strings.Split(value, ";") {
+			cookieName, _, _ := strings.Cut(pair, "=")
+			if strings.TrimSpace(cookieName) != name {
+				pairs = append(pairs, pair)
+			}
+		}
+		if value = strings.TrimSpace(strings.Join(pairs, ";")); value != "" {
+			kept = append(kept, value)
+		}
+	}
+	r.Header.Del("Cookie")
+	for _, value := range kept {
+		r.Header.Add("Cookie", value)
+	}
+}
+
+// transportCache holds a transport per isolation token. The transports send
+// the token as SOCKS credentials. Only the most recently used transports are
+// kept so the idle connections of inactive clients are closed.
+type transportCache struct {
+	mu      sync.Mutex
+	base    *http.Transport
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type transportCacheEntry struct {
+	token     string
+	transport *http.Transport
+}
+
+func newTransportCache(base *http.Transport, size int) *transportCache {
+	if size < 1 {
+		size = 1
+	}
+	return &transportCache{
+		base:    base,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// get returns the transport for token
+func (c *transportCache) get(token string) *http.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[token]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*transportCacheEntry).transport
+	}
+
+	transport := c.base.Clone()
+	transport.Proxy = socksProxy(c.base.Proxy, token)
+	c.entries[token] = c.lru.PushFront(&transportCacheEntry{token: token, transport: transport})
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		entry := oldest.Value.(*transportCacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, entry.token)
+		// running requests keep their connections
+		entry.transport.CloseIdleConnections()
+	}
+	return transport
+}
+
+// socksProxy wraps the Proxy function of a transport. The isolation token and
+// the circuit of a retry are sent as SOCKS credentials so TOR uses different
+// circuits for them.
+func socksProxy(proxy func(*http.Request) (*url.URL, error), token string) func(*http.Request) (*url.URL, error) {
+	return func(r *http.Request) (*url.URL, error) {
+		if proxy == nil {
+			return nil, nil
+		}
+		u, err := proxy(r)
+		if err != nil || u == nil {
+			return u, err
+		}
+		circuit, ok := circuitFromRequest(r)
+		if token == "" && !ok {
+			return u, nil
+		}
+		username, password := token, circuit
+		if username == "" {
+			username = "zwiebelproxy"
+		}
+		if password == "" {
+			password = "zwiebelproxy"
+		}
+		isolated := *u
+		isolated.User = url.UserPassword(username, password)
+		return &isolated, nil
+	}
+}
+
+func (c *transportCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
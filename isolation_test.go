@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIsolationMode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input    string
+		expected isolationMode
+		err      bool
+	}{
+		{"", isolationNone, false},
+		{"client", isolationClient, false},
+		{" Session ", isolationSession, false},
+		{"onion", isolationOnion, false},
+		{"circuit", isolationNone, true},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.input, func(t *testing.T) {
+			t.Parallel()
+
+			mode, err := parseIsolationMode(tt.input)
+			assert.Equal(t, tt.err, err != nil)
+			assert.Equal(t, tt.expected, mode)
+		})
+	}
+}
+
+func TestTransportCache(t *testing.T) {
+	t.Parallel()
+
+	c := newTransportCache(&http.Transport{}, 2)
+	a := c.get("a")
+	b := c.get("b")
+	assert.Same(t, a, c.get("a"))
+	assert.NotSame(t, a, b)
+
+	// b is the least recently used transport
+	c.get("c")
+	assert.Equal(t, 2, c.Len())
+	assert.Same(t, a, c.entries["a"].Value.(*transportCacheEntry).transport)
+	assert.NotSame(t, b, c.get("b"))
+}
+
+func TestRemoveCookie(t *testing.T) {
+	t.Parallel()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Cookie", fmt.Sprintf("a=1; %s=secret; b=2", isolationCookieName))
+	removeCookie(r, isolationCookieName)
+	assert.Equal(t, "a=1; b=2", r.Header.Get("Cookie"))
+
+	// cookies net/http considers invalid are kept as they are
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Cookie", fmt.Sprintf(`pref={"a":1}; b=x y; %s=abc`, authCookieName))
+	removeCookie(r, authCookieName)
+	assert.Equal(t, `pref={"a":1}; b=x y`, r.Header.Get("Cookie"))
+
+	// every Cookie header is cleaned, empty headers are removed
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Add("Cookie", fmt.Sprintf("%s=secret", isolationCookieName))
+	r.Header.Add("Cookie", fmt.Sprintf("%s=secret;a=1", isolationCookieName))
+	removeCookie(r, isolationCookieName)
+	assert.Equal(t, []string{"a=1"}, r.Header.Values("Cookie"))
+
+	r = httptest.NewRequest(http.MethodGet, "/", nil)
+	removeCookie(r, isolationCookieName)
+	assert.Empty(t, r.Header.Values("Cookie"))
+}
+
+func TestIsolation(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	type request struct {
+		remoteAddr string
+		onion      string
+		session    string
+	}
+	tests := []struct {
+		name     string
+		mode     isolationMode
+		requests []request
+		// expected contains the index of the first request sharing the
+		// credentials for every request
+		expected []int
+	}{
+		{"none", isolationNone, []request{{remoteAddr: "192.0.2.1:1"}, {remoteAddr: "192.0.2.2:1"}}, []int{0, 0}},
+		{"client", isolationClient, []request{{remoteAddr: "192.0.2.1:1"}, {remoteAddr: "192.0.2.2:1"}, {remoteAddr: "192.0.2.1:2"}}, []int{0, 1, 0}},
+		{"onion", isolationOnion, []request{{onion: testOnionID}, {onion: testOnionIDOther}, {onion: "api." + testOnionID}}, []int{0, 1, 0}},
+		{"session", isolationSession, []request{{session: "a"}, {session: "b"}, {session: "a"}}, []int{0, 1, 0}},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, r.Header.Get("Cookie"))
+			}))
+			defer upstream.Close()
+
+			socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+			app := newTestApplication(t, domain, socks.URL())
+			app.transport.DisableKeepAlives = true
+			app.isolation = tt.mode
+			app.isolationSecret = []byte("secret")
+			app.transports = newTransportCache(app.transport, 10)
+
+			for _, req := range tt.requests {
+				onion := req.onion
+				if onion == "" {
+					onion = testOnionID
+				}
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.Host = fmt.Sprintf("%s.%s", onion, domain)
+				if req.remoteAddr != "" {
+					r.RemoteAddr = req.remoteAddr
+				}
+				if req.session != "" {
+					r.AddCookie(&http.Cookie{Name: isolationCookieName, Value: req.session})
+					r.AddCookie(&http.Cookie{Name: "other", Value: "1"})
+				}
+				w := httptest.NewRecorder()
+				app.routes().ServeHTTP(w, r)
+				require.Equal(t, http.StatusOK, w.Code)
+				// the session cookie never reaches the onion service
+				assert.NotContains(t, w.Body.String(), isolationCookieName)
+			}
+
+			requests := socks.Requests()
+			require.Len(t, requests, len(tt.requests))
+			for i, j := range tt.expected {
+				if tt.mode == isolationNone {
+					assert.Empty(t, requests[i].Username)
+					continue
+				}
+				assert.NotEmpty(t, requests[i].Username)
+				assert.NotContains(t, requests[i].Username, "192.0.2")
+				if i == j {
+					for k := 0; k < i; k++ {
+						assert.NotEqual(t, requests[k].Username, requests[i].Username, "request %d and %d", k, i)
+					}
+					continue
+				}
+				assert.Equal(t, requests[j].Username, requests[i].Username, "request %d and %d", j, i)
+			}
+		})
+	}
+}
+
+func TestIsolationSessionCookie(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "upstream", Value: "1"})
+	}))
+	defer upstream.Close()
+
+	socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+	app := newTestApplication(t, domain, socks.URL())
+	app.isolation = isolationSession
+	app.isolationSecret = []byte("secret")
+	app.transports = newTransportCache(app.transport, 10)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = fmt.Sprintf("%s.%s", testOnionID, domain)
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	cookies := w.Result().Cookies()
+	require.Len(t, cookies, 2)
+	assert.Equal(t, isolationCookieName, cookies[0].Name)
+	assert.Len(t, cookies[0].Value, 32)
+	assert.Equal(t, domain, cookies[0].Domain)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, "upstream", cookies[1].Name)
+}
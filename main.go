@@ -2,19 +2,20 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"crypto/x509"
 	"embed"
 	"flag"
 	"fmt"
+	"html/template"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"net/netip"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
-	"text/template"
 	"time"
 
 	"github.com/firefart/zwiebelproxy/antikorpsLogger"
@@ -27,10 +28,66 @@ import (
 
 type application struct {
 	transport *http.Transport
-	domain    string
+	tor       *torPool
+	control   *torControl
+	domains   []string
 	timeout   time.Duration
 	logger    Logger
 	templates *template.Template
+	aliases   *aliasTable
+	pathMode  bool
+
+	// longPollPaths use longPollTimeout as idle timeout instead of timeout
+	longPollPaths   []longPollPath
+	longPollTimeout time.Duration
+
+	isolation       isolationMode
+	isolationSecret []byte
+	// transports holds a transport per isolation token
+	transports *transportCache
+
+	htpasswdPath        string
+	authTokens          map[string]string
+	authSecret          []byte
+	authSessionLifetime time.Duration
+	auth                atomic.Pointer[authConfig]
+	oidc                *oidcAuth
+
+	retries         int
+	retryBackoff    time.Duration
+	retryNewCircuit bool
+
+	adminToken     string
+	newnymFailures int
+	// failures counts the consecutive failed requests
+	failures atomic.Int64
+	// bootstrap is the last bootstrap state polled from the control port
+	bootstrap atomic.Pointer[bootstrapState]
+
+	allowlistPath string
+	denylistPath  string
+	acl           atomic.Pointer[onionACL]
+
+	// trustedProxies can set the client address in the X-Real-IP and
+	// X-Forwarded-For headers
+	trustedProxies []netip.Prefix
+	// trustForwarded enables the Forwarded header of the trusted proxies
+	trustForwarded bool
+	// clientRules are the global rules for the client addresses
+	clientRules   clientRules
+	clientACLPath string
+	clientACL     atomic.Pointer[clientACL]
+
+	// userHeader contains the user authenticated by a reverse proxy
+	userHeader     string
+	clientAuthPath string
+	clientAuth     atomic.Pointer[clientAuthStore]
+
+	tlsDefault    tlsMode
+	tlsPolicyPath string
+	tlsPolicies   atomic.Pointer[tlsPolicies]
+	// tlsRoots are the roots for mode verify, the system roots if nil
+	tlsRoots *x509.CertPool
 
 	JsonLogger        antikorpsLogger.MyJsonLogger
 	JsonLoggerEnabled bool
@@ -53,10 +110,49 @@ func main() {
 
 	host := flag.String("host", lookupEnvOrString(log, "ZWIEBEL_HOST", "127.0.0.1:8080"), "IP and Port to bind to. You can also use the ZWIEBEL_HOST environment variable or an entry in the .env file to set this parameter.")
 	debug := flag.Bool("debug", lookupEnvOrBool(log, "ZWIEBEL_DEBUG", false), "Enable DEBUG mode. You can also use the ZWIEBEL_DEBUG environment variable or an entry in the .env file to set this parameter.")
-	domain := flag.String("domain", lookupEnvOrString(log, "ZWIEBEL_DOMAIN", ""), "domain to use. You can also use the ZWIEBEL_DOMAIN environment variable or an entry in the .env file to set this parameter.")
-	tor := flag.String("tor", lookupEnvOrString(log, "ZWIEBEL_TOR", "socks5://127.0.0.1:9050"), "TOR Proxy server. You can also use the ZWIEBEL_TOR environment variable or an entry in the .env file to set this parameter.")
+	domain := flag.String("domain", lookupEnvOrString(log, "ZWIEBEL_DOMAIN", ""), "domain to use, multiple domains can be separated by a comma. You can also use the ZWIEBEL_DOMAIN environment variable or an entry in the .env file to set this parameter.")
+	tor := flag.String("tor", lookupEnvOrString(log, "ZWIEBEL_TOR", "socks5://127.0.0.1:9050"), "TOR Proxy server, multiple servers can be separated by a comma. You can also use the ZWIEBEL_TOR environment variable or an entry in the .env file to set this parameter.")
 	wait := flag.Duration("graceful-timeout", lookupEnvOrDuration(log, "ZWIEBEL_GRACEFUL_TIMEOUT", 5*time.Second), "the duration for which the server gracefully wait for existing connections to finish - e.g. 15s or 1m. You can also use the ZWIEBEL_GRACEFUL_TIMEOUT environment variable or an entry in the .env file to set this parameter.")
 	timeout := flag.Duration("timeout", lookupEnvOrDuration(log, "ZWIEBEL_TIMEOUT", 5*time.Minute), "http timeout. You can also use the ZWIEBEL_TIMEOUT environment variable or an entry in the .env file to set this parameter.")
+	longPoll := flag.String("long-poll-paths", lookupEnvOrString(log, "ZWIEBEL_LONG_POLL_PATHS", ""), "comma separated list of long-poll path prefixes like /poll or <onion host>/poll that use the long-poll timeout. You can also use the ZWIEBEL_LONG_POLL_PATHS environment variable or an entry in the .env file to set this parameter.")
+	longPollTimeout := flag.Duration("long-poll-timeout", lookupEnvOrDuration(log, "ZWIEBEL_LONG_POLL_TIMEOUT", 15*time.Minute), "idle timeout of the long-poll paths. You can also use the ZWIEBEL_LONG_POLL_TIMEOUT environment variable or an entry in the .env file to set this parameter.")
+	aliasFile := flag.String("aliases", lookupEnvOrString(log, "ZWIEBEL_ALIASES", ""), "file containing aliases for onion services, one alias and onion address per line. You can also use the ZWIEBEL_ALIASES environment variable or an entry in the .env file to set this parameter.")
+	allowlist := flag.String("allowlist", lookupEnvOrString(log, "ZWIEBEL_ALLOWLIST", ""), "file containing the onion services that can be reached, one per line. You can also use the ZWIEBEL_ALLOWLIST environment variable or an entry in the .env file to set this parameter.")
+	denylist := flag.String("denylist", lookupEnvOrString(log, "ZWIEBEL_DENYLIST", ""), "file containing the onion services that are blocked, one per line. You can also use the ZWIEBEL_DENYLIST environment variable or an entry in the .env file to set this parameter.")
+	trustedProxies := flag.String("trusted-proxies", lookupEnvOrString(log, "ZWIEBEL_TRUSTED_PROXIES", "127.0.0.0/8,::1"), "comma separated list of networks of the reverse proxies in front of the proxy. Only these can set the client address in the X-Real-IP and X-Forwarded-For headers. You can also use the ZWIEBEL_TRUSTED_PROXIES environment variable or an entry in the .env file to set this parameter.")
+	trustForwarded := flag.Bool("trust-forwarded", lookupEnvOrBool(log, "ZWIEBEL_TRUST_FORWARDED", false), "read the client address, host and scheme from the Forwarded header of the trusted proxies. Only set this if the reverse proxy always overwrites the header. You can also use the ZWIEBEL_TRUST_FORWARDED environment variable or an entry in the .env file to set this parameter.")
+	clientAllow := flag.String("client-allow", lookupEnvOrString(log, "ZWIEBEL_CLIENT_ALLOW", ""), "comma separated list of networks of the clients that can use the proxy. If empty all clients that are not denied can use the proxy. You can also use the ZWIEBEL_CLIENT_ALLOW environment variable or an entry in the .env file to set this parameter.")
+	clientDeny := flag.String("client-deny", lookupEnvOrString(log, "ZWIEBEL_CLIENT_DENY", ""), "comma separated list of networks of the clients that are blocked. You can also use the ZWIEBEL_CLIENT_DENY environment variable or an entry in the .env file to set this parameter.")
+	clientACLFile := flag.String("client-acl", lookupEnvOrString(log, "ZWIEBEL_CLIENT_ACL", ""), "file containing client networks per onion service that override the global client rules. You can also use the ZWIEBEL_CLIENT_ACL environment variable or an entry in the .env file to set this parameter.")
+	torHealthInterval := flag.Duration("tor-health-interval", lookupEnvOrDuration(log, "ZWIEBEL_TOR_HEALTH_INTERVAL", 30*time.Second), "interval of the health checks of the TOR proxy servers. You can also use the ZWIEBEL_TOR_HEALTH_INTERVAL environment variable or an entry in the .env file to set this parameter.")
+	torHealthTarget := flag.String("tor-health-target", lookupEnvOrString(log, "ZWIEBEL_TOR_HEALTH_TARGET", ""), "host:port to connect to through the TOR proxy servers during a health check. If empty only the SOCKS handshake is checked. You can also use the ZWIEBEL_TOR_HEALTH_TARGET environment variable or an entry in the .env file to set this parameter.")
+	torControlAddress := flag.String("tor-control", lookupEnvOrString(log, "ZWIEBEL_TOR_CONTROL", ""), "address of the TOR control port like 127.0.0.1:9051, enables the bootstrap status and requesting new circuits. You can also use the ZWIEBEL_TOR_CONTROL environment variable or an entry in the .env file to set this parameter.")
+	torControlPassword := flag.String("tor-control-password", lookupEnvOrString(log, "ZWIEBEL_TOR_CONTROL_PASSWORD", ""), "password of the TOR control port. You can also use the ZWIEBEL_TOR_CONTROL_PASSWORD environment variable or an entry in the .env file to set this parameter.")
+	torControlCookie := flag.String("tor-control-cookie", lookupEnvOrString(log, "ZWIEBEL_TOR_CONTROL_COOKIE", ""), "path to the cookie file of the TOR control port. If neither a password nor a cookie file is set the cookie file announced by TOR is used. You can also use the ZWIEBEL_TOR_CONTROL_COOKIE environment variable or an entry in the .env file to set this parameter.")
+	newnymFailures := flag.Int("tor-newnym-failures", lookupEnvOrInt(log, "ZWIEBEL_TOR_NEWNYM_FAILURES", 0), "request new TOR circuits after this many consecutive requests failed because of TOR, 0 disables it. You can also use the ZWIEBEL_TOR_NEWNYM_FAILURES environment variable or an entry in the .env file to set this parameter.")
+	clientAuth := flag.String("client-auth", lookupEnvOrString(log, "ZWIEBEL_CLIENT_AUTH", ""), "file containing the v3 client authorization keys of onion services, needs the TOR control port. You can also use the ZWIEBEL_CLIENT_AUTH environment variable or an entry in the .env file to set this parameter.")
+	userHeader := flag.String("user-header", lookupEnvOrString(log, "ZWIEBEL_USER_HEADER", ""), "header containing the user authenticated by the reverse proxy in front of the proxy like X-Forwarded-User. Only set this if the reverse proxy always overwrites the header. You can also use the ZWIEBEL_USER_HEADER environment variable or an entry in the .env file to set this parameter.")
+	htpasswd := flag.String("auth-htpasswd", lookupEnvOrString(log, "ZWIEBEL_AUTH_HTPASSWD", ""), "htpasswd file with bcrypt hashes of the users that can log in to the proxy. You can also use the ZWIEBEL_AUTH_HTPASSWD environment variable or an entry in the .env file to set this parameter.")
+	authTokens := flag.String("auth-tokens", lookupEnvOrString(log, "ZWIEBEL_AUTH_TOKENS", ""), "comma separated list of name:token pairs, the tokens can be sent in an Authorization: Bearer header. You can also use the ZWIEBEL_AUTH_TOKENS environment variable or an entry in the .env file to set this parameter.")
+	authSecret := flag.String("auth-secret", lookupEnvOrString(log, "ZWIEBEL_AUTH_SECRET", ""), "secret used to sign the session cookies. If empty a random secret is used and all users need to log in again after a restart. You can also use the ZWIEBEL_AUTH_SECRET environment variable or an entry in the .env file to set this parameter.")
+	oidcIssuer := flag.String("oidc-issuer", lookupEnvOrString(log, "ZWIEBEL_OIDC_ISSUER", ""), "issuer url of the OpenID Connect provider used to log in to the proxy. The callback url is /oidc/callback on the proxy domain. You can also use the ZWIEBEL_OIDC_ISSUER environment variable or an entry in the .env file to set this parameter.")
+	oidcClientID := flag.String("oidc-client-id", lookupEnvOrString(log, "ZWIEBEL_OIDC_CLIENT_ID", ""), "client id at the OpenID Connect provider. You can also use the ZWIEBEL_OIDC_CLIENT_ID environment variable or an entry in the .env file to set this parameter.")
+	oidcClientSecret := flag.String("oidc-client-secret", lookupEnvOrString(log, "ZWIEBEL_OIDC_CLIENT_SECRET", ""), "client secret at the OpenID Connect provider, can be empty for public clients. You can also use the ZWIEBEL_OIDC_CLIENT_SECRET environment variable or an entry in the .env file to set this parameter.")
+	oidcScopes := flag.String("oidc-scopes", lookupEnvOrString(log, "ZWIEBEL_OIDC_SCOPES", "openid,profile,email"), "comma separated list of scopes requested from the OpenID Connect provider. You can also use the ZWIEBEL_OIDC_SCOPES environment variable or an entry in the .env file to set this parameter.")
+	oidcUserClaim := flag.String("oidc-user-claim", lookupEnvOrString(log, "ZWIEBEL_OIDC_USER_CLAIM", "preferred_username"), "claim of the id token containing the user name, falls back to sub. You can also use the ZWIEBEL_OIDC_USER_CLAIM environment variable or an entry in the .env file to set this parameter.")
+	oidcGroupsClaim := flag.String("oidc-groups-claim", lookupEnvOrString(log, "ZWIEBEL_OIDC_GROUPS_CLAIM", "groups"), "claim of the id token containing the groups of the user. You can also use the ZWIEBEL_OIDC_GROUPS_CLAIM environment variable or an entry in the .env file to set this parameter.")
+	oidcAllowedGroups := flag.String("oidc-allowed-groups", lookupEnvOrString(log, "ZWIEBEL_OIDC_ALLOWED_GROUPS", ""), "comma separated list of groups that can use the proxy. If empty all users of the provider can use the proxy. You can also use the ZWIEBEL_OIDC_ALLOWED_GROUPS environment variable or an entry in the .env file to set this parameter.")
+	oidcRequiredClaims := flag.String("oidc-required-claims", lookupEnvOrString(log, "ZWIEBEL_OIDC_REQUIRED_CLAIMS", ""), "comma separated list of claim=value pairs that must be present in the id token like email_verified=true. You can also use the ZWIEBEL_OIDC_REQUIRED_CLAIMS environment variable or an entry in the .env file to set this parameter.")
+	authSessionLifetime := flag.Duration("auth-session-lifetime", lookupEnvOrDuration(log, "ZWIEBEL_AUTH_SESSION_LIFETIME", 24*time.Hour), "lifetime of a login session. You can also use the ZWIEBEL_AUTH_SESSION_LIFETIME environment variable or an entry in the .env file to set this parameter.")
+	retries := flag.Int("retries", lookupEnvOrInt(log, "ZWIEBEL_RETRIES", 2), "number of retries of GET, HEAD and OPTIONS requests failing with a temporary TOR error, 0 disables retries. You can also use the ZWIEBEL_RETRIES environment variable or an entry in the .env file to set this parameter.")
+	retryBackoff := flag.Duration("retry-backoff", lookupEnvOrDuration(log, "ZWIEBEL_RETRY_BACKOFF", 1*time.Second), "delay before the first retry, it doubles with every retry. You can also use the ZWIEBEL_RETRY_BACKOFF environment variable or an entry in the .env file to set this parameter.")
+	retryNewCircuit := flag.Bool("retry-new-circuit", lookupEnvOrBool(log, "ZWIEBEL_RETRY_NEW_CIRCUIT", false), "use a new TOR circuit for every retry. You can also use the ZWIEBEL_RETRY_NEW_CIRCUIT environment variable or an entry in the .env file to set this parameter.")
+	tlsPolicy := flag.String("tls-policy", lookupEnvOrString(log, "ZWIEBEL_TLS_POLICY", ""), "file containing the tls verification policies of https onion services. You can also use the ZWIEBEL_TLS_POLICY environment variable or an entry in the .env file to set this parameter.")
+	tlsDefault := flag.String("tls-default", lookupEnvOrString(log, "ZWIEBEL_TLS_DEFAULT", string(tlsSkip)), "tls verification of https onion services without a policy, skip or verify. You can also use the ZWIEBEL_TLS_DEFAULT environment variable or an entry in the .env file to set this parameter.")
+	adminToken := flag.String("admin-token", lookupEnvOrString(log, "ZWIEBEL_ADMIN_TOKEN", ""), "bearer token for the admin endpoints, they are disabled if empty. You can also use the ZWIEBEL_ADMIN_TOKEN environment variable or an entry in the .env file to set this parameter.")
+	isolation := flag.String("isolation", lookupEnvOrString(log, "ZWIEBEL_ISOLATION", ""), "isolate the TOR circuits per client ip (client), per browser session (session) or per onion service (onion). Needs IsolateSOCKSAuth on the SocksPort of TOR which is enabled by default. You can also use the ZWIEBEL_ISOLATION environment variable or an entry in the .env file to set this parameter.")
+	isolationCache := flag.Int("isolation-cache", lookupEnvOrInt(log, "ZWIEBEL_ISOLATION_CACHE", 1000), "maximum number of isolated transports kept open. You can also use the ZWIEBEL_ISOLATION_CACHE environment variable or an entry in the .env file to set this parameter.")
+	pathMode := flag.Bool("path-mode", lookupEnvOrBool(log, "ZWIEBEL_PATH_MODE", false), "Also proxy onion services under /o/<onion address>/ on the domain itself, for setups without a wildcard DNS record. You can also use the ZWIEBEL_PATH_MODE environment variable or an entry in the .env file to set this parameter.")
 	jsonPath := flag.String("jsonpath", "", "absolute path folder for the json log files")
 	var jsonLoggerEnabled bool
 	var jsonLogger antikorpsLogger.MyJsonLogger
@@ -81,7 +177,8 @@ func main() {
 		}
 	}
 
-	if len(*domain) == 0 {
+	domains := parseDomains(*domain)
+	if len(domains) == 0 {
 		log.Errorf("please provide a domain")
 		if jsonLoggerEnabled {
 			jsonLogger.ErrorLevel("please provide a domain")
@@ -89,44 +186,262 @@ func main() {
 		os.Exit(1)
 	}
 
-	if !strings.HasPrefix(*domain, ".") {
-		var a = fmt.Sprintf(".%s", *domain)
-		domain = &a
+	torProxyURLs, err := parseTorBackends(*tor)
+	if err != nil {
+		log.Error(err)
+		if jsonLoggerEnabled {
+			jsonLogger.ErrorLevel(err.Error())
+		}
+		os.Exit(1)
 	}
-
-	torProxyURL, err := url.Parse(*tor)
+	if *torHealthInterval <= 0 {
+		log.Errorf("the TOR health check interval needs to be positive, got %s", *torHealthInterval)
+		if jsonLoggerEnabled {
+			message := fmt.Sprintf("the TOR health check interval needs to be positive, got %s", *torHealthInterval)
+			jsonLogger.ErrorLevel(message)
+		}
+		os.Exit(1)
+	}
+	longPollPaths, err := parseLongPollPaths(*longPoll)
 	if err != nil {
-		log.Errorf("invalid proxy url %s: %v", *tor, err)
+		log.Error(err)
 		if jsonLoggerEnabled {
-			message := fmt.Sprintf("invalid proxy url %s: %v", *tor, err)
+			jsonLogger.ErrorLevel(err.Error())
+		}
+		os.Exit(1)
+	}
+	if len(longPollPaths) > 0 && *longPollTimeout <= 0 {
+		log.Errorf("the long-poll timeout needs to be positive, got %s", *longPollTimeout)
+		if jsonLoggerEnabled {
+			message := fmt.Sprintf("the long-poll timeout needs to be positive, got %s", *longPollTimeout)
 			jsonLogger.ErrorLevel(message)
 		}
 		os.Exit(1)
 	}
+	isolationMode, err := parseIsolationMode(*isolation)
+	if err != nil {
+		log.Error(err)
+		if jsonLoggerEnabled {
+			jsonLogger.ErrorLevel(err.Error())
+		}
+		os.Exit(1)
+	}
+
+	tlsDefaultMode, err := parseTLSMode(*tlsDefault)
+	if err == nil && tlsDefaultMode == tlsPin {
+		err = fmt.Errorf("tls mode pin needs pins and can only be used in the tls policy file")
+	}
+	if err != nil {
+		log.Error(err)
+		if jsonLoggerEnabled {
+			jsonLogger.ErrorLevel(err.Error())
+		}
+		os.Exit(1)
+	}
+
+	trustedProxyNetworks, err := parsePrefixes(*trustedProxies)
+	if err != nil {
+		err = fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+	var clientAllowNetworks, clientDenyNetworks []netip.Prefix
+	if err == nil {
+		clientAllowNetworks, err = parsePrefixes(*clientAllow)
+		if err != nil {
+			err = fmt.Errorf("invalid client allowlist: %w", err)
+		}
+	}
+	if err == nil {
+		clientDenyNetworks, err = parsePrefixes(*clientDeny)
+		if err != nil {
+			err = fmt.Errorf("invalid client denylist: %w", err)
+		}
+	}
+	if err != nil {
+		log.Error(err)
+		if jsonLoggerEnabled {
+			jsonLogger.ErrorLevel(err.Error())
+		}
+		os.Exit(1)
+	}
+
+	tokens, err := parseAuthTokens(*authTokens)
+	if err != nil {
+		log.Error(err)
+		if jsonLoggerEnabled {
+			jsonLogger.ErrorLevel(err.Error())
+		}
+		os.Exit(1)
+	}
+	secret := []byte(*authSecret)
+	if len(secret) == 0 {
+		secret = []byte(randomToken())
+	}
+
+	var oidcLogin *oidcAuth
+	if *oidcIssuer != "" {
+		oidcLogin, err = newOIDCAuth(context.Background(), *oidcIssuer, *oidcClientID, *oidcClientSecret, parseOIDCList(*oidcScopes), *timeout)
+		if err == nil {
+			oidcLogin.requiredClaims, err = parseOIDCClaims(*oidcRequiredClaims)
+		}
+		if err != nil {
+			log.Error(err)
+			if jsonLoggerEnabled {
+				jsonLogger.ErrorLevel(err.Error())
+			}
+			os.Exit(1)
+		}
+		if claim := strings.TrimSpace(*oidcUserClaim); claim != "" {
+			oidcLogin.userClaim = claim
+		}
+		oidcLogin.groupsClaim = strings.TrimSpace(*oidcGroupsClaim)
+		for _, group := range parseOIDCList(*oidcAllowedGroups) {
+			oidcLogin.allowedGroups[group] = struct{}{}
+		}
+	}
+
+	torPool := newTorPool(torProxyURLs, *torHealthTarget, *timeout)
+
+	var aliases *aliasTable
+	if *aliasFile != "" {
+		aliases, err = loadAliases(*aliasFile)
+		if err != nil {
+			log.Errorf("could not load aliases from %s: %v", *aliasFile, err)
+			if jsonLoggerEnabled {
+				message := fmt.Sprintf("could not load aliases from %s: %v", *aliasFile, err)
+				jsonLogger.ErrorLevel(message)
+			}
+			os.Exit(1)
+		}
+		log.Infof("loaded %d aliases from %s", aliases.Len(), *aliasFile)
+		if jsonLoggerEnabled {
+			message := fmt.Sprintf("loaded %d aliases from %s", aliases.Len(), *aliasFile)
+			jsonLogger.DebugLevel(message)
+		}
+	}
 
 	// used to clone the default transport
 	tr := http.DefaultTransport.(*http.Transport)
-	tr.Proxy = http.ProxyURL(torProxyURL)
-	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	tr.Proxy = socksProxy(torPool.proxy, "")
 	tr.TLSHandshakeTimeout = *timeout
 	tr.ExpectContinueTimeout = *timeout
 	tr.ResponseHeaderTimeout = *timeout
-
-	tr.DialContext = (&net.Dialer{
-		Timeout:   *timeout,
-		KeepAlive: *timeout,
-	}).DialContext
+	// long-polls wait for the response headers
+	if len(longPollPaths) > 0 && *longPollTimeout > *timeout {
+		tr.ResponseHeaderTimeout = *longPollTimeout
+	}
 
 	app := &application{
-		transport:         tr,
-		domain:            *domain,
-		timeout:           *timeout,
-		logger:            log,
-		templates:         template.Must(template.ParseFS(templateFS, "templates/*.tmpl")),
-		JsonLogger:        jsonLogger,
-		JsonLoggerEnabled: jsonLoggerEnabled,
+		transport:           tr,
+		tor:                 torPool,
+		domains:             domains,
+		timeout:             *timeout,
+		longPollPaths:       longPollPaths,
+		longPollTimeout:     *longPollTimeout,
+		logger:              log,
+		templates:           template.Must(template.ParseFS(templateFS, "templates/*.tmpl")),
+		aliases:             aliases,
+		pathMode:            *pathMode,
+		isolation:           isolationMode,
+		isolationSecret:     []byte(randomToken()),
+		transports:          newTransportCache(tr, *isolationCache),
+		adminToken:          *adminToken,
+		newnymFailures:      *newnymFailures,
+		allowlistPath:       *allowlist,
+		denylistPath:        *denylist,
+		trustedProxies:      trustedProxyNetworks,
+		trustForwarded:      *trustForwarded,
+		clientRules:         clientRules{allow: clientAllowNetworks, deny: clientDenyNetworks},
+		clientACLPath:       *clientACLFile,
+		userHeader:          http.CanonicalHeaderKey(strings.TrimSpace(*userHeader)),
+		clientAuthPath:      *clientAuth,
+		tlsDefault:          tlsDefaultMode,
+		htpasswdPath:        *htpasswd,
+		authTokens:          tokens,
+		authSecret:          secret,
+		authSessionLifetime: *authSessionLifetime,
+		oidc:                oidcLogin,
+		retries:             *retries,
+		retryBackoff:        *retryBackoff,
+		retryNewCircuit:     *retryNewCircuit,
+		tlsPolicyPath:       *tlsPolicy,
+		JsonLogger:          jsonLogger,
+		JsonLoggerEnabled:   jsonLoggerEnabled,
+	}
+
+	if err := app.loadACL(); err != nil {
+		log.Error(err)
+		if jsonLoggerEnabled {
+			jsonLogger.ErrorLevel(err.Error())
+		}
+		os.Exit(1)
+	}
+	if err := app.loadClientACL(); err != nil {
+		log.Error(err)
+		if jsonLoggerEnabled {
+			jsonLogger.ErrorLevel(err.Error())
+		}
+		os.Exit(1)
+	}
+	if err := app.loadTLSPolicies(); err != nil {
+		log.Error(err)
+		if jsonLoggerEnabled {
+			jsonLogger.ErrorLevel(err.Error())
+		}
+		os.Exit(1)
+	}
+	if err := app.loadAuth(); err != nil {
+		log.Error(err)
+		if jsonLoggerEnabled {
+			jsonLogger.ErrorLevel(err.Error())
+		}
+		os.Exit(1)
+	}
+	tr.TLSClientConfig = app.tlsClientConfig()
+
+	if *torControlAddress != "" {
+		app.control = newTorControl(*torControlAddress, *torControlPassword, *torControlCookie, *timeout)
+		bootstrap, err := app.control.bootstrap(context.Background())
+		if err != nil {
+			log.Warnf("could not get the bootstrap status of TOR: %v", err)
+			if jsonLoggerEnabled {
+				message := fmt.Sprintf("could not get the bootstrap status of TOR: %v", err)
+				jsonLogger.ErrorLevel(message)
+			}
+		} else {
+			log.Infof("TOR bootstrap progress %d%%: %s", bootstrap.Progress, bootstrap.Summary)
+			if jsonLoggerEnabled {
+				message := fmt.Sprintf("TOR bootstrap progress %d%%: %s", bootstrap.Progress, bootstrap.Summary)
+				jsonLogger.DebugLevel(message)
+			}
+		}
+	}
+
+	if app.clientAuthPath != "" {
+		if app.control == nil {
+			log.Error("client authorization keys need the TOR control port")
+			if jsonLoggerEnabled {
+				jsonLogger.ErrorLevel("client authorization keys need the TOR control port")
+			}
+			os.Exit(1)
+		}
+		if err := app.loadClientAuth(context.Background()); err != nil {
+			log.Error(err)
+			if jsonLoggerEnabled {
+				jsonLogger.ErrorLevel(err.Error())
+			}
+			// TOR may not be running yet, the keys are pushed again on reload
+			if app.clientAuth.Load() == nil {
+				os.Exit(1)
+			}
+		}
 	}
 
+	tr.DialContext = app.dialTor((&net.Dialer{
+		Timeout:   *timeout,
+		KeepAlive: *timeout,
+	}).DialContext)
+	go app.torHealthCheck(context.Background(), *torHealthInterval)
+
 	srv := &http.Server{
 		Addr:    *host,
 		Handler: app.routes(),
@@ -146,6 +461,15 @@ func main() {
 		}
 	}()
 
+	// reload the configuration files on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			app.reload()
+		}
+	}()
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
 	<-c
@@ -164,34 +488,100 @@ func main() {
 	os.Exit(0)
 }
 
+// reload reloads all configuration files that can change at runtime
+func (app *application) reload() {
+	app.logger.Info("reloading configuration")
+	if app.JsonLoggerEnabled {
+		app.JsonLogger.DebugLevel("reloading configuration")
+	}
+	if err := app.loadACL(); err != nil {
+		app.logger.Error(err)
+		if app.JsonLoggerEnabled {
+			app.JsonLogger.ErrorLevel(err.Error())
+		}
+	}
+	if err := app.loadClientACL(); err != nil {
+		app.logger.Error(err)
+		if app.JsonLoggerEnabled {
+			app.JsonLogger.ErrorLevel(err.Error())
+		}
+	}
+	if err := app.loadTLSPolicies(); err != nil {
+		app.logger.Error(err)
+		if app.JsonLoggerEnabled {
+			app.JsonLogger.ErrorLevel(err.Error())
+		}
+	}
+	if err := app.loadAuth(); err != nil {
+		app.logger.Error(err)
+		if app.JsonLoggerEnabled {
+			app.JsonLogger.ErrorLevel(err.Error())
+		}
+	}
+	if err := app.loadClientAuth(context.Background()); err != nil {
+		app.logger.Error(err)
+		if app.JsonLoggerEnabled {
+			app.JsonLogger.ErrorLevel(err.Error())
+		}
+	}
+}
+
 func (app *application) routes() http.Handler {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	r.Use(app.realIPMiddleware)
 	r.Use(middleware.Logger)
 	r.Use(app.xHeaderMiddleware)
 	r.Use(middleware.Recoverer)
+	r.Use(app.clientACLMiddleware)
+	if app.authEnabled() {
+		r.Use(app.authMiddleware)
+	}
 
 	ph := http.HandlerFunc(app.proxyHandler)
+	if app.authEnabled() {
+		r.Handle(loginPath, http.HandlerFunc(app.loginHandler))
+		r.Handle(logoutPath, http.HandlerFunc(app.logoutHandler))
+	}
+	if app.oidc != nil {
+		r.Handle(oidcStartPath, http.HandlerFunc(app.oidcStartHandler))
+		r.Handle(oidcCallbackPath, http.HandlerFunc(app.oidcCallbackHandler))
+	}
+	r.Handle(statusPath, http.HandlerFunc(app.statusHandler))
+	if app.control != nil && app.adminToken != "" {
+		r.Handle(newnymPath, http.HandlerFunc(app.newnymHandler))
+	}
+	if app.pathMode {
+		r.Handle(fmt.Sprintf("%s{name}", pathPrefix), http.HandlerFunc(app.pathRedirectHandler))
+		r.Handle(fmt.Sprintf("%s{name}/*", pathPrefix), http.HandlerFunc(app.pathHandler))
+	}
 	r.Handle("/*", ph)
 	return r
 }
 
 func (app *application) logError(w http.ResponseWriter, err error, statusCode int) {
-	w.WriteHeader(statusCode)
-	w.Header().Set("Connection", "close")
 	errorText := fmt.Sprintf("%v", err)
 	app.logger.Error(errorText)
 	if app.JsonLoggerEnabled {
 		app.JsonLogger.DebugLevel(err.Error())
 	}
+	app.renderError(w, statusCode, errorPage{Error: errorText})
+}
 
-	data := struct {
-		Error string
-	}{
-		Error: errorText,
-	}
+// errorPage is rendered by default.tmpl, only Error is set for errors that
+// are not classified
+type errorPage struct {
+	Error       string
+	Code        string
+	Title       string
+	Explanation string
+}
+
+func (app *application) renderError(w http.ResponseWriter, statusCode int, data errorPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(statusCode)
 	if err2 := app.templates.ExecuteTemplate(w, "default.tmpl", data); err2 != nil {
 		app.logger.Error(err2)
 		if app.JsonLoggerEnabled {
@@ -206,13 +596,27 @@ func (app *application) logError(w http.ResponseWriter, err error, statusCode in
 }
 
 func (app *application) proxyHandler(w http.ResponseWriter, r *http.Request) {
-	host, _, err := net.SplitHostPort(r.Host)
+	host, port, err := net.SplitHostPort(r.Host)
 	if err != nil {
 		// no port present
 		host = r.Host
+		port = r.URL.Port()
 	}
+	host = strings.ToLower(host)
 
-	if host == strings.TrimLeft(app.domain, ".") {
+	domain, ok := app.matchDomain(host)
+	if !ok {
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("invalid domain %s called. The domain needs to end in %s %d", host, strings.Join(app.domains, " or "), http.StatusBadRequest)
+			app.JsonLogger.ErrorLevel(message)
+		}
+		app.logError(w, fmt.Errorf("invalid domain %s called. The domain needs to end in %s", host, strings.Join(app.domains, " or ")), http.StatusBadRequest)
+		return
+	}
+	r = withProxyDomain(r, domain)
+
+	if host == strings.TrimLeft(domain, ".") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		if err := app.templates.ExecuteTemplate(w, "default.tmpl", nil); err != nil {
 			if app.JsonLoggerEnabled {
 				message := "error on executing template:" + err.Error()
@@ -223,14 +627,41 @@ func (app *application) proxyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !strings.HasSuffix(host, app.domain) {
+	// validate the onion address before sending anything to TOR
+	target, err := app.onionTarget(host, port, domain)
+	if err != nil {
 		if app.JsonLoggerEnabled {
-			message := fmt.Sprintf("invalid domain %s called. The domain needs to end in %s %d", host, app.domain, http.StatusBadRequest)
+			message := fmt.Sprintf("%v %d", err, http.StatusBadRequest)
 			app.JsonLogger.ErrorLevel(message)
 		}
-		app.logError(w, fmt.Errorf("invalid domain %s called. The domain needs to end in %s", host, app.domain), http.StatusBadRequest)
+		app.logError(w, err, http.StatusBadRequest)
+		return
+	}
+	r.Host = strings.ToLower(r.Host)
+	app.serveOnion(w, r, target)
+}
+
+// serveOnion proxies the request to the onion service
+func (app *application) serveOnion(w http.ResponseWriter, r *http.Request, target onionTarget) {
+	if !app.clientACL.Load().allowedOnion(r, target) {
+		app.blocked(w, target, http.StatusForbidden, fmt.Errorf("%w: %s", errClientBlocked, r.RemoteAddr))
+		return
+	}
+	if !app.acl.Load().allowed(target) {
+		app.blocked(w, target, http.StatusUnavailableForLegalReasons, errOnionBlocked)
 		return
 	}
+	if !app.clientAuth.Load().authorized(target, app.requestUser(r)) {
+		app.blocked(w, target, http.StatusForbidden, errOnionUnauthorized)
+		return
+	}
+	r = withOnionTarget(r, target)
+
+	app.logger.Debugf("routing request to service %s with subdomains %v and alias %q", target.ServiceID, target.Subdomains, target.Alias)
+	if app.JsonLoggerEnabled {
+		message := fmt.Sprintf("routing request to service %s with subdomains %v and alias %q", target.ServiceID, target.Subdomains, target.Alias)
+		app.JsonLogger.DebugLevel(message)
+	}
 
 	proxy := httputil.ReverseProxy{
 		Director: app.director,
@@ -239,6 +670,12 @@ func (app *application) proxyHandler(w http.ResponseWriter, r *http.Request) {
 	proxy.FlushInterval = -1
 	proxy.ModifyResponse = app.modifyResponse
 	proxy.Transport = app.transport
+	if token := app.isolationToken(w, r, target); token != "" {
+		proxy.Transport = app.transports.get(token)
+	}
+	if app.retries > 0 {
+		proxy.Transport = &retryTransport{app: app, next: proxy.Transport}
+	}
 	proxy.ErrorHandler = app.proxyErrorHandler
 
 	app.logger.Debugf("sending request %+v", r)
@@ -247,21 +684,56 @@ func (app *application) proxyHandler(w http.ResponseWriter, r *http.Request) {
 		app.JsonLogger.WriteToFile(message)
 	}
 
-	// set a custom timeout
-	ctx, cancel := context.WithTimeout(r.Context(), app.timeout)
-	defer cancel()
-	r = r.WithContext(ctx)
+	// upgraded connections like websockets are long lived so only the
+	// transport timeouts apply while connecting
+	if isUpgradeRequest(r) {
+		app.logger.Debugf("detected upgrade request to %s", sanitizeString(r.Header.Get("Upgrade")))
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("detected upgrade request to %s", sanitizeString(r.Header.Get("Upgrade")))
+			app.JsonLogger.DebugLevel(message)
+		}
+		proxy.ServeHTTP(w, r)
+		return
+	}
+
+	// set a custom timeout, streaming responses switch it to an idle timeout
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	timeout := app.timeout
+	longPoll := app.isLongPoll(r, target)
+	if longPoll {
+		timeout = app.longPollTimeout
+	}
+	deadline := newRequestDeadline(timeout, func() {
+		cancel(errRequestTimeout)
+	})
+	defer deadline.stop()
+	// long-polls wait for the response so they start with the idle timeout
+	if longPoll {
+		app.logger.Debugf("detected long-poll request to %s", sanitizeString(r.URL.Path))
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("detected long-poll request to %s", sanitizeString(r.URL.Path))
+			app.JsonLogger.DebugLevel(message)
+		}
+		deadline.switchToIdle()
+	}
+	r = withRequestDeadline(r.WithContext(ctx), deadline)
 	proxy.ServeHTTP(w, r)
 }
 
 func (app *application) xHeaderMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// the headers of other clients are removed without using them as
+		// they could point the proxy to a different host or scheme
+		trusted := fromTrustedProxy(r)
+		var forwarded []string
 		for headerName, headerValue := range r.Header {
 			switch strings.ToLower(headerName) {
-			case "x-real-ip":
-				// this is already handled by the RealIP middleware
-				delete(r.Header, headerName)
 			case "x-forwarded-port":
+				if !trusted {
+					delete(r.Header, headerName)
+					continue
+				}
 				port := headerValue[0]
 				host, _, err := net.SplitHostPort(r.URL.Host)
 				if err != nil {
@@ -291,10 +763,36 @@ func (app *application) xHeaderMiddleware(next http.Handler) http.Handler {
 				}
 				delete(r.Header, headerName)
 			case "x-forwarded-proto":
-				r.URL.Scheme = headerValue[0]
+				if scheme := strings.ToLower(headerValue[0]); trusted && (scheme == "http" || scheme == "https") {
+					r.URL.Scheme = scheme
+				}
+				delete(r.Header, headerName)
+			case "forwarded":
+				if trusted && app.trustForwarded {
+					forwarded = headerValue
+				}
 				delete(r.Header, headerName)
 			}
 		}
+		// the standard header wins over the X-Forwarded headers, the last
+		// element was added by the proxy in front of us
+		if elements := parseForwarded(forwarded); len(elements) > 0 {
+			element := elements[len(elements)-1]
+			if element.Proto == "http" || element.Proto == "https" {
+				r.URL.Scheme = element.Proto
+			}
+			if element.Host != "" && !strings.ContainsAny(element.Host, "/?#@ ") {
+				r.Host = element.Host
+			}
+		}
+		scheme := r.URL.Scheme
+		if scheme == "" {
+			scheme = "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+		}
+		r = withClientScheme(r, scheme)
 		next.ServeHTTP(rw, r)
 	})
 }
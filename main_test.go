@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestApplication returns an application sending all requests through the
+// SOCKS server at socksURL
+func newTestApplication(t *testing.T, domain, socksURL string) *application {
+	t.Helper()
+
+	proxyURL, err := url.Parse(socksURL)
+	require.Nil(t, err)
+	return &application{
+		transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+		},
+		domains:   []string{fmt.Sprintf(".%s", domain)},
+		timeout:   5 * time.Second,
+		logger:    &DiscardLogger{},
+		templates: template.Must(template.ParseFS(templateFS, "templates/*.tmpl")),
+	}
+}
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// writeWebsocketFrame writes a single text frame
+// https://www.rfc-editor.org/rfc/rfc6455#section-5.2
+func writeWebsocketFrame(w io.Writer, payload []byte, masked bool) error {
+	frame := []byte{0x81}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	default:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	}
+	data := append([]byte(nil), payload...)
+	if masked {
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+func readWebsocketFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	var mask []byte
+	if header[1]&0x80 != 0 {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	for i := range payload {
+		if mask != nil {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return payload, nil
+}
+
+// websocketEchoHandler echoes every text frame back to the client
+func websocketEchoHandler(origins chan<- string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgradeRequest(r) {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		origins <- r.Header.Get("Origin")
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+		if err := rw.Flush(); err != nil {
+			return
+		}
+		for {
+			payload, err := readWebsocketFrame(rw)
+			if err != nil {
+				return
+			}
+			if err := writeWebsocketFrame(conn, payload, false); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func TestWebsocketUpgrade(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	origins := make(chan string, 1)
+	echo := httptest.NewServer(websocketEchoHandler(origins))
+	defer echo.Close()
+
+	socks := newFakeSOCKSServer(t, echo.Listener.Addr().String())
+	app := newTestApplication(t, domain, socks.URL())
+	// upgraded connections must outlive the request timeout
+	app.timeout = 100 * time.Millisecond
+	proxy := httptest.NewServer(app.routes())
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+	require.Nil(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	fmt.Fprintf(conn, "GET /chat HTTP/1.1\r\nHost: %s.%s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nOrigin: http://%s.%s\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", testOnionID, domain, testOnionID, domain, key)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, websocketAccept(key), resp.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, fmt.Sprintf("http://%s.onion", testOnionID), <-origins)
+
+	requests := socks.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, fmt.Sprintf("%s.onion", testOnionID), requests[0].Host)
+	assert.Equal(t, 80, requests[0].Port)
+
+	time.Sleep(3 * app.timeout)
+
+	for _, message := range []string{"hello", "http://asdf.onion/ stays untouched"} {
+		require.Nil(t, writeWebsocketFrame(conn, []byte(message), true))
+		payload, err := readWebsocketFrame(reader)
+		require.Nil(t, err)
+		assert.Equal(t, message, string(payload))
+	}
+}
+
+func TestProxyHandlerValidatesOnion(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		name           string
+		host           string
+		expectedStatus int
+		expectedHost   string
+		expectedError  string
+	}{
+		{"valid", fmt.Sprintf("%s.%s", testOnionID, domain), http.StatusOK, fmt.Sprintf("%s.onion", testOnionID), ""},
+		{"uppercase", fmt.Sprintf("%s.%s", strings.ToUpper(testOnionID), strings.ToUpper(domain)), http.StatusOK, fmt.Sprintf("%s.onion", testOnionID), ""},
+		{"subdomain", fmt.Sprintf("api.%s.%s", testOnionID, domain), http.StatusOK, fmt.Sprintf("api.%s.onion", testOnionID), ""},
+		{"invalid subdomain order", fmt.Sprintf("%s.api.%s", testOnionID, domain), http.StatusBadRequest, "", "invalid onion address"},
+		{"v2", fmt.Sprintf("3g2upl4pq6kufc4m.%s", domain), http.StatusBadRequest, "", "deprecated"},
+		{"garbage", fmt.Sprintf("www.%s", domain), http.StatusBadRequest, "", "invalid onion address"},
+		{"checksum", fmt.Sprintf("e%s.%s", testOnionID[1:], domain), http.StatusBadRequest, "", "checksum mismatch"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "ok")
+			}))
+			defer upstream.Close()
+
+			socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+			app := newTestApplication(t, domain, socks.URL())
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			app.routes().ServeHTTP(w, r)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.Contains(t, w.Body.String(), tt.expectedError)
+			requests := socks.Requests()
+			if tt.expectedHost == "" {
+				assert.Empty(t, requests)
+				return
+			}
+			require.Len(t, requests, 1)
+			assert.Equal(t, tt.expectedHost, requests[0].Host)
+		})
+	}
+}
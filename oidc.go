@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcStartPath and oidcCallbackPath are served on the proxy domain. The
+	// callback url needs to be registered at the identity provider.
+	oidcStartPath    = "/oidc/login"
+	oidcCallbackPath = "/oidc/callback"
+	// oidcStateCookieName holds the state of a running login
+	oidcStateCookieName = "zwiebelproxy_oidc"
+	// oidcStateLifetime is the time a user has to log in at the provider
+	oidcStateLifetime = 10 * time.Minute
+)
+
+var (
+	errOIDCState     = errors.New("the login expired or was started in another browser, please try again")
+	errOIDCForbidden = errors.New("you are not allowed to use this proxy")
+	errOIDCProvider  = errors.New("the login at the identity provider failed, please try again")
+)
+
+// oidcAuth logs users in at an OpenID Connect provider
+type oidcAuth struct {
+	config   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+	// client is used for all requests to the provider. It does not use the
+	// default transport which is routed through TOR.
+	client *http.Client
+	// userClaim contains the name of the user, falls back to sub
+	userClaim   string
+	groupsClaim string
+	// allowedGroups are the groups that can use the proxy, all users can
+	// use the proxy if it is empty
+	allowedGroups map[string]struct{}
+	// requiredClaims must be present in the id token with the given value
+	requiredClaims map[string]string
+}
+
+// oidcState is stored in the state cookie during a login
+type oidcState struct {
+	State    string `json:"state"`
+	Verifier string `json:"verifier"`
+	Nonce    string `json:"nonce"`
+	Next     string `json:"next"`
+	Expiry   int64  `json:"expiry"`
+}
+
+// newOIDCAuth discovers the endpoints of the issuer
+func newOIDCAuth(ctx context.Context, issuer, clientID, clientSecret string, scopes []string, timeout time.Duration) (*oidcAuth, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   timeout,
+				KeepAlive: timeout,
+			}).DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+		Timeout: timeout,
+	}
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, client), issuer)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover the oidc issuer %s: %w", issuer, err)
+	}
+	hasOpenID := false
+	for _, scope := range scopes {
+		if scope == oidc.ScopeOpenID {
+			hasOpenID = true
+		}
+	}
+	if !hasOpenID {
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+	}
+	return &oidcAuth{
+		config: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       scopes,
+		},
+		verifier:       provider.Verifier(&oidc.Config{ClientID: clientID}),
+		client:         client,
+		userClaim:      "preferred_username",
+		groupsClaim:    "groups",
+		allowedGroups:  make(map[string]struct{}),
+		requiredClaims: make(map[string]string),
+	}, nil
+}
+
+// parseOIDCList parses a comma separated list of scopes or groups
+func parseOIDCList(s string) []string {
+	var list []string
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// parseOIDCClaims parses a comma separated list of claim=value pairs
+func parseOIDCClaims(s string) (map[string]string, error) {
+	claims := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		claim, value, ok := strings.Cut(entry, "=")
+		if !ok || claim == "" {
+			return nil, fmt.Errorf("invalid claim %q, expected claim=value", entry)
+		}
+		claims[claim] = value
+	}
+	return claims, nil
+}
+
+// claimValues returns a claim as list of strings. Claims can be strings,
+// lists of strings or other json values like booleans.
+func claimValues(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, value := range v {
+			values = append(values, fmt.Sprint(value))
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// authorize returns the user of the id token claims if the user is allowed
+// to use the proxy
+func (o *oidcAuth) authorize(claims map[string]interface{}) (string, error) {
+	user := ""
+	if values := claimValues(claims, o.userClaim); len(values) == 1 {
+		user = values[0]
+	}
+	if user == "" {
+		if values := claimValues(claims, "sub"); len(values) == 1 {
+			user = values[0]
+		}
+	}
+	if user == "" {
+		return "", errors.New("the id token does not contain a user")
+	}
+
+	for claim, expected := range o.requiredClaims {
+		found := false
+		for _, value := range claimValues(claims, claim) {
+			if value == expected {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return user, fmt.Errorf("%w: claim %s is not %q", errOIDCForbidden, claim, expected)
+		}
+	}
+
+	if len(o.allowedGroups) == 0 {
+		return user, nil
+	}
+	for _, group := range claimValues(claims, o.groupsClaim) {
+		if _, ok := o.allowedGroups[group]; ok {
+			return user, nil
+		}
+	}
+	return user, fmt.Errorf("%w: not a member of an allowed group", errOIDCForbidden)
+}
+
+// oidcRedirectURL returns the callback url on the proxy domain of the request
+func (app *application) oidcRedirectURL(r *http.Request) (string, bool) {
+	u, ok := app.proxyURL(r)
+	if !ok {
+		return "", false
+	}
+	u.Path = oidcCallbackPath
+	return u.String(), true
+}
+
+// oidcStateCookie returns the cookie holding the state of a login. It is only
+// sent to the callback on the proxy domain.
+func (app *application) oidcStateCookie(r *http.Request, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    value,
+		Path:     oidcCallbackPath,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.EqualFold(clientScheme(r), "https"),
+		// the callback is a top level navigation from the provider
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// oidcStartHandler redirects to the provider using the authorization code
+// flow with PKCE
+func (app *application) oidcStartHandler(w http.ResponseWriter, r *http.Request) {
+	domain, ok := app.proxyHost(r)
+	if !ok {
+		app.proxyHandler(w, r)
+		return
+	}
+	r = withProxyDomain(r, domain)
+
+	redirectURL, ok := app.oidcRedirectURL(r)
+	if !ok {
+		app.logError(w, fmt.Errorf("invalid domain %s", sanitizeString(r.Host)), http.StatusBadRequest)
+		return
+	}
+
+	expires := time.Now().Add(oidcStateLifetime)
+	state := oidcState{
+		State:    randomToken(),
+		Verifier: oauth2.GenerateVerifier(),
+		Nonce:    randomToken(),
+		Next:     r.URL.Query().Get("next"),
+		Expiry:   expires.Unix(),
+	}
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		app.logError(w, fmt.Errorf("could not encode the oidc state: %w", err), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, app.oidcStateCookie(r, app.sign(base64.RawURLEncoding.EncodeToString(encoded)), expires))
+
+	config := app.oidc.config
+	config.RedirectURL = redirectURL
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, config.AuthCodeURL(state.State, oauth2.S256ChallengeOption(state.Verifier), oidc.Nonce(state.Nonce)), http.StatusFound)
+}
+
+// readOIDCState returns the state of the login from the state cookie
+func (app *application) readOIDCState(r *http.Request) (oidcState, error) {
+	var state oidcState
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil {
+		return state, errOIDCState
+	}
+	payload, ok := app.verifySignature(cookie.Value)
+	if !ok {
+		return state, errOIDCState
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return state, errOIDCState
+	}
+	if err := json.Unmarshal(decoded, &state); err != nil {
+		return state, errOIDCState
+	}
+	if time.Now().After(time.Unix(state.Expiry, 0)) || state.State != r.URL.Query().Get("state") {
+		return state, errOIDCState
+	}
+	return state, nil
+}
+
+// oidcCallbackHandler exchanges the authorization code, verifies the id
+// token and creates a session valid for all subdomains of the proxy domain
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	domain, ok := app.proxyHost(r)
+	if !ok {
+		app.proxyHandler(w, r)
+		return
+	}
+	r = withProxyDomain(r, domain)
+
+	// the state is only valid once
+	cookie := app.oidcStateCookie(r, "", time.Unix(0, 0))
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+
+	query := r.URL.Query()
+	if errorCode := query.Get("error"); errorCode != "" {
+		// the error is controlled by whoever sent the link so it is only logged
+		app.logger.Infof("the identity provider returned an error for %s: %s %s", r.RemoteAddr, sanitizeString(errorCode), sanitizeString(query.Get("error_description")))
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("the identity provider returned an error for %s: %s %s", r.RemoteAddr, sanitizeString(errorCode), sanitizeString(query.Get("error_description")))
+			app.JsonLogger.DebugLevel(message)
+		}
+		app.renderError(w, http.StatusUnauthorized, errorPage{Error: errOIDCProvider.Error()})
+		return
+	}
+
+	state, err := app.readOIDCState(r)
+	if err != nil {
+		app.logError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	redirectURL, ok := app.oidcRedirectURL(r)
+	if !ok {
+		app.logError(w, fmt.Errorf("invalid domain %s", sanitizeString(r.Host)), http.StatusBadRequest)
+		return
+	}
+	config := app.oidc.config
+	config.RedirectURL = redirectURL
+
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, app.oidc.client)
+	token, err := config.Exchange(ctx, query.Get("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		app.logError(w, fmt.Errorf("could not exchange the authorization code: %w", err), http.StatusBadGateway)
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		app.logError(w, errors.New("the identity provider did not return an id token"), http.StatusBadGateway)
+		return
+	}
+	idToken, err := app.oidc.verifier.Verify(oidc.ClientContext(r.Context(), app.oidc.client), rawIDToken)
+	if err != nil {
+		app.logError(w, fmt.Errorf("could not verify the id token: %w", err), http.StatusUnauthorized)
+		return
+	}
+	if idToken.Nonce != state.Nonce {
+		app.logError(w, errors.New("the nonce of the id token does not match"), http.StatusUnauthorized)
+		return
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		app.logError(w, fmt.Errorf("could not decode the id token claims: %w", err), http.StatusBadGateway)
+		return
+	}
+	user, err := app.oidc.authorize(claims)
+	if err != nil {
+		app.logger.Infof("denied oidc login of user %q from %s: %v", sanitizeString(user), r.RemoteAddr, err)
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("denied oidc login of user %q from %s: %v", sanitizeString(user), r.RemoteAddr, err)
+			app.JsonLogger.DebugLevel(message)
+		}
+		app.renderError(w, http.StatusForbidden, errorPage{Error: errOIDCForbidden.Error()})
+		return
+	}
+
+	expires := time.Now().Add(app.authSessionLifetime)
+	http.SetCookie(w, app.authCookie(r, app.signSession(sessionOIDC, user, expires), expires))
+	http.Redirect(w, r, app.redirectTarget(r, state.Next), http.StatusSeeOther)
+}
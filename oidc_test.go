@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testOIDCClientID     = "zwiebelproxy"
+	testOIDCClientSecret = "client-secret"
+)
+
+// mockOIDCIssuer is a minimal OpenID Connect provider. Every authorization
+// request is approved for the user with the current claims.
+type mockOIDCIssuer struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	claims map[string]interface{}
+	codes  map[string]mockOIDCCode
+}
+
+// mockOIDCCode is an issued authorization code
+type mockOIDCCode struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+	claims      map[string]interface{}
+}
+
+func newMockOIDCIssuer(t *testing.T) *mockOIDCIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	m := &mockOIDCIssuer{
+		t:      t,
+		key:    key,
+		claims: map[string]interface{}{"sub": "1234"},
+		codes:  make(map[string]mockOIDCCode),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+func (m *mockOIDCIssuer) URL() string {
+	return m.server.URL
+}
+
+func (m *mockOIDCIssuer) setClaims(claims map[string]interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.claims = claims
+}
+
+func (m *mockOIDCIssuer) discovery(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                m.URL(),
+		"authorization_endpoint":                m.URL() + "/authorize",
+		"token_endpoint":                        m.URL() + "/token",
+		"jwks_uri":                              m.URL() + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (m *mockOIDCIssuer) jwks(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (m *mockOIDCIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != testOIDCClientID || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	code := randomToken()
+	m.mu.Lock()
+	m.codes[code] = mockOIDCCode{
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		redirectURI: query.Get("redirect_uri"),
+		claims:      m.claims,
+	}
+	m.mu.Unlock()
+
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	redirect.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (m *mockOIDCIssuer) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if clientID != testOIDCClientID || clientSecret != testOIDCClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	m.mu.Lock()
+	code, ok := m.codes[r.PostFormValue("code")]
+	delete(m.codes, r.PostFormValue("code"))
+	m.mu.Unlock()
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || code.redirectURI != r.PostFormValue("redirect_uri") || base64.RawURLEncoding.EncodeToString(challenge[:]) != code.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := map[string]interface{}{
+		"iss":   m.URL(),
+		"aud":   testOIDCClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": code.nonce,
+	}
+	for k, v := range code.claims {
+		claims[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": randomToken(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     m.sign(claims),
+	})
+}
+
+// sign returns a RS256 signed jwt
+func (m *mockOIDCIssuer) sign(claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	require.Nil(m.t, err)
+	payload, err := json.Marshal(claims)
+	require.Nil(m.t, err)
+	signingInput := fmt.Sprintf("%s.%s", base64.RawURLEncoding.EncodeToString(header), base64.RawURLEncoding.EncodeToString(payload))
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, hash[:])
+	require.Nil(m.t, err)
+	return fmt.Sprintf("%s.%s", signingInput, base64.RawURLEncoding.EncodeToString(signature))
+}
+
+func TestParseOIDCClaims(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected map[string]string
+		err      bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"claims", "email_verified=true, hd=example.com", map[string]string{"email_verified": "true", "hd": "example.com"}, false},
+		{"empty value", "acr=", map[string]string{"acr": ""}, false},
+		{"missing value", "email_verified", nil, true},
+		{"missing claim", "=true", nil, true},
+	}
+
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			claims, err := parseOIDCClaims(tt.input)
+			if tt.err {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tt.expected, claims)
+		})
+	}
+}
+
+func TestOIDCAuthorize(t *testing.T) {
+	t.Parallel()
+
+	o := &oidcAuth{
+		userClaim:      "preferred_username",
+		groupsClaim:    "groups",
+		allowedGroups:  map[string]struct{}{"admins": {}, "ops": {}},
+		requiredClaims: map[string]string{"email_verified": "true"},
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		user   string
+		err    bool
+	}{
+		{"allowed", map[string]interface{}{"sub": "1", "preferred_username": "alice", "email_verified": true, "groups": []interface{}{"users", "ops"}}, "alice", false},
+		{"single group", map[string]interface{}{"sub": "1", "preferred_username": "alice", "email_verified": true, "groups": "admins"}, "alice", false},
+		{"sub fallback", map[string]interface{}{"sub": "1", "email_verified": true, "groups": []interface{}{"admins"}}, "1", false},
+		{"wrong group", map[string]interface{}{"sub": "1", "preferred_username": "alice", "email_verified": true, "groups": []interface{}{"users"}}, "alice", true},
+		{"no groups", map[string]interface{}{"sub": "1", "preferred_username": "alice", "email_verified": true}, "alice", true},
+		{"claim mismatch", map[string]interface{}{"sub": "1", "preferred_username": "alice", "email_verified": false, "groups": []interface{}{"admins"}}, "alice", true},
+		{"claim missing", map[string]interface{}{"sub": "1", "preferred_username": "alice", "groups": []interface{}{"admins"}}, "alice", true},
+		{"no user", map[string]interface{}{"email_verified": true, "groups": []interface{}{"admins"}}, "", true},
+	}
+
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			user, err := o.authorize(tt.claims)
+			if tt.err {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, tt.user, user)
+		})
+	}
+}
+
+func TestOIDC(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "cookie=%s", r.Header.Get("Cookie"))
+	}))
+	defer upstream.Close()
+
+	issuer := newMockOIDCIssuer(t)
+	socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+	app := newTestApplication(t, domain, socks.URL())
+	var err error
+	app.oidc, err = newOIDCAuth(context.Background(), issuer.URL(), testOIDCClientID, testOIDCClientSecret, []string{"profile"}, 5*time.Second)
+	require.Nil(t, err)
+	app.oidc.allowedGroups = map[string]struct{}{"admins": {}}
+	app.authSecret = []byte("secret")
+	app.authSessionLifetime = time.Hour
+	require.Nil(t, app.loadAuth())
+	handler := app.routes()
+
+	request := func(target string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	noRedirect := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	// login runs the flow from the start url and returns the response of
+	// the callback
+	login := func(startURL string) *httptest.ResponseRecorder {
+		w := request(startURL, nil)
+		require.Equal(t, http.StatusFound, w.Code)
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+		assert.Equal(t, oidcStateCookieName, cookies[0].Name)
+		assert.Equal(t, oidcCallbackPath, cookies[0].Path)
+
+		authorizeURL, err := url.Parse(w.Header().Get("Location"))
+		require.Nil(t, err)
+		assert.True(t, strings.HasPrefix(authorizeURL.String(), issuer.URL()+"/authorize?"))
+		query := authorizeURL.Query()
+		assert.Equal(t, "S256", query.Get("code_challenge_method"))
+		assert.NotEmpty(t, query.Get("code_challenge"))
+		assert.NotEmpty(t, query.Get("nonce"))
+		assert.Equal(t, "openid profile", query.Get("scope"))
+		assert.Equal(t, fmt.Sprintf("http://%s%s", domain, oidcCallbackPath), query.Get("redirect_uri"))
+
+		resp, err := noRedirect.Get(authorizeURL.String())
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusFound, resp.StatusCode)
+		return request(resp.Header.Get("Location"), http.Header{"Cookie": {fmt.Sprintf("%s=%s", cookies[0].Name, cookies[0].Value)}})
+	}
+
+	// without a htpasswd file browsers are sent to the provider directly
+	onionURL := fmt.Sprintf("http://%s.%s/path?a=b", testOnionID, domain)
+	w := request(onionURL, nil)
+	assert.Equal(t, http.StatusFound, w.Code)
+	startURL := fmt.Sprintf("http://%s%s?next=%s", domain, oidcStartPath, url.QueryEscape(onionURL))
+	assert.Equal(t, startURL, w.Header().Get("Location"))
+	assert.Empty(t, socks.Requests())
+
+	// users not in an allowed group are rejected
+	issuer.setClaims(map[string]interface{}{"sub": "1", "preferred_username": "bob", "groups": []interface{}{"users"}})
+	w = login(startURL)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	for _, cookie := range w.Result().Cookies() {
+		assert.NotEqual(t, authCookieName, cookie.Name)
+	}
+
+	// allowed users get a session for all subdomains of the proxy domain
+	issuer.setClaims(map[string]interface{}{"sub": "2", "preferred_username": "alice", "groups": []interface{}{"users", "admins"}})
+	w = login(startURL)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, onionURL, w.Header().Get("Location"))
+	var session *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == authCookieName {
+			session = cookie
+		}
+	}
+	require.NotNil(t, session)
+	assert.Equal(t, domain, session.Domain)
+	method, user, ok := app.verifySession(session.Value)
+	assert.True(t, ok)
+	assert.Equal(t, sessionOIDC, method)
+	assert.Equal(t, "alice", user)
+
+	cookie := fmt.Sprintf("%s=%s; other=1", authCookieName, session.Value)
+	w = request(onionURL, http.Header{"Cookie": {cookie}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "cookie=other=1", w.Body.String())
+	w = request(fmt.Sprintf("http://%s.%s/", testOnionIDOther, domain), http.Header{"Cookie": {cookie}})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// open redirects are not possible
+	w = login(fmt.Sprintf("http://%s%s?next=%s", domain, oidcStartPath, url.QueryEscape("https://evil.example/")))
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	assert.Equal(t, "/", w.Header().Get("Location"))
+
+	// the callback needs the state cookie of the browser that started the
+	// login
+	w = request(startURL, nil)
+	require.Equal(t, http.StatusFound, w.Code)
+	resp, err := noRedirect.Get(w.Header().Get("Location"))
+	require.Nil(t, err)
+	resp.Body.Close()
+	callbackURL := resp.Header.Get("Location")
+	assert.Equal(t, http.StatusBadRequest, request(callbackURL, nil).Code)
+	stateCookie := w.Result().Cookies()[0]
+	tampered := strings.Replace(callbackURL, "state=", "state=x", 1)
+	assert.Equal(t, http.StatusBadRequest, request(tampered, http.Header{"Cookie": {fmt.Sprintf("%s=%s", stateCookie.Name, stateCookie.Value)}}).Code)
+
+	// errors of the provider
+	w = request(fmt.Sprintf("http://%s%s?error=access_denied&error_description=%s", domain, oidcCallbackPath, url.QueryEscape("<script>alert(1)</script>")), nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), errOIDCProvider.Error())
+	assert.NotContains(t, w.Body.String(), "alert(1)")
+}
+
+func TestOIDCLoginPage(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	issuer := newMockOIDCIssuer(t)
+	app := newTestApplication(t, domain, "socks5://127.0.0.1:9050")
+	var err error
+	app.oidc, err = newOIDCAuth(context.Background(), issuer.URL(), testOIDCClientID, testOIDCClientSecret, nil, 5*time.Second)
+	require.Nil(t, err)
+	app.htpasswdPath = "htpasswd"
+	app.auth.Store(&authConfig{})
+
+	// with a htpasswd file both logins are offered
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s?next=x", domain, loginPath), nil)
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `<form method="post" action="/login">`)
+	assert.Contains(t, w.Body.String(), fmt.Sprintf(`<form method="get" action="%s">`, oidcStartPath))
+}
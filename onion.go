@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	onionV2Length      = 16
+	onionV3Length      = 56
+	onionV3Version     = 0x03
+	onionChecksumConst = ".onion checksum"
+)
+
+var (
+	errOnionV2      = errors.New("v2 onion addresses are deprecated and no longer supported by TOR, please use the v3 address of the service")
+	errOnionInvalid = errors.New("invalid onion address")
+)
+
+var onionBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// validateOnionID checks that id is a valid v3 onion service id (without the
+// .onion suffix) and returns it in lower case
+// https://gitlab.torproject.org/tpo/core/torspec/-/blob/main/rend-spec-v3.txt (section 6)
+func validateOnionID(id string) (string, error) {
+	id = strings.ToLower(id)
+	decoded, err := onionBase32.DecodeString(strings.ToUpper(id))
+	if err != nil {
+		return "", fmt.Errorf("%w %q: not base32 encoded", errOnionInvalid, id)
+	}
+
+	switch len(id) {
+	case onionV2Length:
+		return "", fmt.Errorf("%q: %w", id, errOnionV2)
+	case onionV3Length:
+	default:
+		return "", fmt.Errorf("%w %q: v3 addresses are %d characters long", errOnionInvalid, id, onionV3Length)
+	}
+
+	// onion_address = base32(PUBKEY | CHECKSUM | VERSION)
+	pubkey, checksum, version := decoded[:32], decoded[32:34], decoded[34]
+	if version != onionV3Version {
+		return "", fmt.Errorf("%w %q: unknown version %d", errOnionInvalid, id, version)
+	}
+
+	// CHECKSUM = H(".onion checksum" | PUBKEY | VERSION)[:2]
+	h := sha3.New256()
+	h.Write([]byte(onionChecksumConst))
+	h.Write(pubkey)
+	h.Write([]byte{version})
+	if !bytes.Equal(h.Sum(nil)[:2], checksum) {
+		return "", fmt.Errorf("%w %q: checksum mismatch", errOnionInvalid, id)
+	}
+
+	return id, nil
+}
+
+// onionTarget is the hidden service a request is routed to. A host like
+// api.<service id>.onion.tld results in the service id, the subdomain api and
+// the port of the request.
+type onionTarget struct {
+	ServiceID  string
+	Subdomains []string
+	Port       string
+	// Alias is set if the service was requested by its alias
+	Alias string
+}
+
+// newOnionTarget splits name, a hostname without the .onion or proxy domain
+// suffix, into its labels
+func newOnionTarget(name, port string) onionTarget {
+	labels := strings.Split(strings.Trim(name, "."), ".")
+	return onionTarget{
+		ServiceID:  labels[len(labels)-1],
+		Subdomains: labels[:len(labels)-1],
+		Port:       port,
+	}
+}
+
+// parseOnionTarget parses a hostname ending in suffix, for example .onion or
+// the proxy domain, and validates the service id
+func parseOnionTarget(hostname, port, suffix string) (onionTarget, error) {
+	if len(hostname) <= len(suffix) || !strings.EqualFold(hostname[len(hostname)-len(suffix):], suffix) {
+		return onionTarget{}, fmt.Errorf("%w %q: needs to end in %s", errOnionInvalid, hostname, suffix)
+	}
+	target := newOnionTarget(strings.ToLower(hostname[:len(hostname)-len(suffix)]), port)
+	id, err := validateOnionID(target.ServiceID)
+	if err != nil {
+		return onionTarget{}, err
+	}
+	target.ServiceID = id
+	return target, nil
+}
+
+// onionTargetForHostname splits an onion hostname found in a response without
+// validating it. The second return value is false for non onion hostnames.
+func onionTargetForHostname(hostname string) (onionTarget, bool) {
+	if len(hostname) <= len(".onion") || !strings.EqualFold(hostname[len(hostname)-len(".onion"):], ".onion") {
+		return onionTarget{}, false
+	}
+	return newOnionTarget(hostname[:len(hostname)-len(".onion")], ""), true
+}
+
+// Name returns the labels in front of the suffix
+func (t onionTarget) Name() string {
+	return strings.Join(append(append([]string{}, t.Subdomains...), t.ServiceID), ".")
+}
+
+// Hostname returns the full onion hostname without a port
+func (t onionTarget) Hostname() string {
+	return fmt.Sprintf("%s.onion", t.Name())
+}
+
+// Host returns the onion hostname including non default ports
+func (t onionTarget) Host() string {
+	if t.Port != "" && t.Port != "80" && t.Port != "443" {
+		return net.JoinHostPort(t.Hostname(), t.Port)
+	}
+	return t.Hostname()
+}
+
+func (t onionTarget) String() string {
+	return t.Host()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// valid v3 onion service ids for tests
+const (
+	testOnionID      = "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad"
+	testOnionIDOther = "2gzyxa5ihm7nsggfxnu52rck2vv4rvmdlkiu3zzui5du4xyclen53wid"
+)
+
+func TestValidateOnionID(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		id       string
+		expected string
+		err      error
+	}{
+		{"valid", testOnionID, testOnionID, nil},
+		{"valid other", testOnionIDOther, testOnionIDOther, nil},
+		{"uppercase", "DuckDuckGoGG42XJOC72X3SJASOWOARFBGCMVFIMAFTT6TWAGSWZCZAD", testOnionID, nil},
+		{"v2", "3g2upl4pq6kufc4m", "", errOnionV2},
+		{"empty", "", "", errOnionInvalid},
+		{"garbage", "www", "", errOnionInvalid},
+		{"not base32", "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzcza1", "", errOnionInvalid},
+		{"checksum", "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczbd", "", errOnionInvalid},
+		{"version", "duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzcyaa", "", errOnionInvalid},
+		{"too long", testOnionID + "aaaaaaaa", "", errOnionInvalid},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			res, err := validateOnionID(tt.id)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, res)
+		})
+	}
+}
+
+func TestParseOnionTarget(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name               string
+		hostname           string
+		port               string
+		suffix             string
+		expectedID         string
+		expectedSubdomains []string
+		expectedHost       string
+		err                error
+	}{
+		{"service", testOnionID + ".onion.tld", "", ".onion.tld", testOnionID, []string{}, testOnionID + ".onion", nil},
+		{"subdomain", "api." + testOnionID + ".onion.tld", "", ".onion.tld", testOnionID, []string{"api"}, "api." + testOnionID + ".onion", nil},
+		{"nested subdomains", "v1.API." + strings.ToUpper(testOnionID) + ".ONION.TLD", "", ".onion.tld", testOnionID, []string{"v1", "api"}, "v1.api." + testOnionID + ".onion", nil},
+		{"port", testOnionID + ".onion.tld", "8080", ".onion.tld", testOnionID, []string{}, testOnionID + ".onion:8080", nil},
+		{"default port", testOnionID + ".onion.tld", "443", ".onion.tld", testOnionID, []string{}, testOnionID + ".onion", nil},
+		{"onion suffix", "www." + testOnionID + ".onion", "", ".onion", testOnionID, []string{"www"}, "www." + testOnionID + ".onion", nil},
+		{"invalid service", "api.www.onion.tld", "", ".onion.tld", "", nil, "", errOnionInvalid},
+		{"service in front", testOnionID + ".api.onion.tld", "", ".onion.tld", "", nil, "", errOnionInvalid},
+		{"other domain", testOnionID + ".example.com", "", ".onion.tld", "", nil, "", errOnionInvalid},
+		{"only domain", ".onion.tld", "", ".onion.tld", "", nil, "", errOnionInvalid},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			target, err := parseOnionTarget(tt.hostname, tt.port, tt.suffix)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expectedID, target.ServiceID)
+			assert.Equal(t, tt.expectedSubdomains, target.Subdomains)
+			assert.Equal(t, tt.expectedHost, target.Host())
+		})
+	}
+}
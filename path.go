@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// pathPrefix is the prefix of all urls in path mode. A request to
+// https://proxy.tld/o/<service id>/path is proxied to http://<service id>.onion/path
+// so no wildcard DNS record and certificate is needed.
+const pathPrefix = "/o/"
+
+// pathRoute is set on requests proxied in path mode
+type pathRoute struct {
+	// Host is the host of the proxy the client connected to
+	Host string
+	// Prefix is the path of the onion service on the proxy like /o/<service id>
+	Prefix string
+}
+
+// onion urls in bodies and headers we can not parse
+var pathOnionURLRegex = regexp.MustCompile(`(?i)//[a-z0-9-]+(\.[a-z0-9-]+)*\.onion(:[0-9]{1,5})?`)
+
+// proxyHost returns the proxy domain if the client requested the domain
+// itself and not a subdomain
+func (app *application) proxyHost(r *http.Request) (string, bool) {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		// no port present
+		host = r.Host
+	}
+	host = strings.ToLower(host)
+	domain, ok := app.matchDomain(host)
+	if !ok || host != strings.TrimLeft(domain, ".") {
+		return "", false
+	}
+	return domain, true
+}
+
+// pathHandler proxies requests in path mode
+func (app *application) pathHandler(w http.ResponseWriter, r *http.Request) {
+	domain, ok := app.proxyHost(r)
+	if !ok {
+		// onion services reached via a subdomain can use the same paths
+		app.proxyHandler(w, r)
+		return
+	}
+
+	segment, err := url.PathUnescape(chi.URLParam(r, "name"))
+	if err != nil {
+		app.logError(w, fmt.Errorf("%w %q: %v", errOnionInvalid, chi.URLParam(r, "name"), err), http.StatusBadRequest)
+		return
+	}
+	name, port := segment, ""
+	if h, p, err := net.SplitHostPort(segment); err == nil {
+		name, port = h, p
+	}
+	if !isPathSegmentValid(name, port) {
+		app.logError(w, fmt.Errorf("%w %q", errOnionInvalid, segment), http.StatusBadRequest)
+		return
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".onion")
+
+	// validate the onion address before sending anything to TOR
+	target, err := app.onionTarget(fmt.Sprintf("%s%s", name, domain), port, domain)
+	if err != nil {
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("%v %d", err, http.StatusBadRequest)
+			app.JsonLogger.ErrorLevel(message)
+		}
+		app.logError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	r = withProxyDomain(r, domain)
+	r = withPathRoute(r, pathRoute{
+		Host:   strings.ToLower(r.Host),
+		Prefix: fmt.Sprintf("%s%s", pathPrefix, segment),
+	})
+	app.serveOnion(w, r, target)
+}
+
+// pathRedirectHandler adds the trailing slash to /o/<service id> so relative
+// links in the document resolve below the prefix
+func (app *application) pathRedirectHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.proxyHost(r); !ok {
+		app.proxyHandler(w, r)
+		return
+	}
+	location := fmt.Sprintf("%s/", r.URL.EscapedPath())
+	if r.URL.RawQuery != "" {
+		location = fmt.Sprintf("%s?%s", location, r.URL.RawQuery)
+	}
+	http.Redirect(w, r, location, http.StatusMovedPermanently)
+}
+
+func isPathSegmentValid(name, port string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isHostnameChar(name[i]) {
+			return false
+		}
+	}
+	for i := 0; i < len(port); i++ {
+		if port[i] < '0' || port[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// stripPathPrefix removes /o/<service id> from the url sent to the onion service
+func stripPathPrefix(u *url.URL) {
+	rest := strings.TrimPrefix(u.EscapedPath(), pathPrefix)
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest = rest[i:]
+	} else {
+		rest = "/"
+	}
+	path, err := url.PathUnescape(rest)
+	if err != nil {
+		return
+	}
+	u.Path = path
+	u.RawPath = rest
+}
+
+// rewritePath returns the path on the proxy for an onion host. The host may
+// contain a port. The second return value is false if the host is no onion
+// host.
+func (l *linkRewriter) rewritePath(host string) (string, bool) {
+	hostname, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		hostname, port = h, p
+	}
+	name, ok := l.onionName(hostname)
+	if !ok {
+		return "", false
+	}
+	if port != "" {
+		name = net.JoinHostPort(name, port)
+	}
+	return fmt.Sprintf("%s%s", pathPrefix, strings.ToLower(name)), true
+}
+
+// rewritePathURL maps absolute and protocol relative onion urls to the proxy
+// and prefixes root relative urls with the path of the current service
+func (l *linkRewriter) rewritePathURL(raw string) string {
+	start, end := urlAuthority(raw)
+	if start < 0 {
+		trimmed := strings.TrimLeft(raw, " \t\r\n\f")
+		if !strings.HasPrefix(trimmed, "/") || strings.HasPrefix(trimmed, "//") || strings.HasPrefix(trimmed, `/\`) {
+			return raw
+		}
+		return fmt.Sprintf("%s%s%s", raw[:len(raw)-len(trimmed)], l.path.Prefix, trimmed)
+	}
+	authority := raw[start:end]
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		// the proxy can not pass on credentials in the url
+		authority = authority[i+1:]
+	}
+	prefix, ok := l.rewritePath(authority)
+	if !ok {
+		return raw
+	}
+	rest := raw[end:]
+	if !strings.HasPrefix(rest, "/") {
+		rest = fmt.Sprintf("/%s", rest)
+	}
+	return fmt.Sprintf("%s%s%s%s", raw[:start], l.path.Host, prefix, rest)
+}
+
+// reversePath maps urls on the proxy back to their onion hosts. Urls outside
+// of the path of a service, like the Origin header, are mapped to the current
+// service.
+func (l *linkRewriter) reversePath(data []byte) []byte {
+	lower := bytes.ToLower(data)
+	needle := []byte(fmt.Sprintf("//%s", strings.ToLower(l.path.Host)))
+	current := l.onionHostForSegment(strings.TrimPrefix(l.path.Prefix, pathPrefix))
+	var out bytes.Buffer
+	last := 0
+	for offset := 0; ; {
+		i := bytes.Index(lower[offset:], needle)
+		if i < 0 {
+			break
+		}
+		start := offset + i
+		end := start + len(needle)
+		offset = end
+		if end < len(data) && (isHostnameChar(data[end]) || data[end] == ':') {
+			// a different host or port
+			continue
+		}
+		host := current
+		if bytes.HasPrefix(lower[end:], []byte(pathPrefix)) {
+			segmentStart := end + len(pathPrefix)
+			segmentEnd := segmentStart
+			for segmentEnd < len(data) && (isHostnameChar(data[segmentEnd]) || data[segmentEnd] == ':') {
+				segmentEnd++
+			}
+			if segmentEnd > segmentStart {
+				host = l.onionHostForSegment(string(lower[segmentStart:segmentEnd]))
+				end = segmentEnd
+				offset = end
+			}
+		}
+		out.Write(data[last:start])
+		out.WriteString(fmt.Sprintf("//%s", host))
+		last = end
+	}
+	if last == 0 {
+		return data
+	}
+	out.Write(data[last:])
+	return out.Bytes()
+}
+
+// onionHostForSegment returns the onion host for a path segment like
+// <service id>, an alias or api.<service id>:8080
+func (l *linkRewriter) onionHostForSegment(segment string) string {
+	name, port := segment, ""
+	if h, p, err := net.SplitHostPort(segment); err == nil {
+		name, port = h, p
+	}
+	target := newOnionTarget(strings.TrimSuffix(strings.ToLower(name), ".onion"), port)
+	if id, ok := l.aliases.lookupName(target.ServiceID); ok {
+		target.ServiceID = id
+	}
+	if port != "" {
+		return net.JoinHostPort(target.Hostname(), port)
+	}
+	return target.Hostname()
+}
+
+// pathReplacer maps onion urls to the proxy in bodies we can not parse
+type pathReplacer struct {
+	links *linkRewriter
+}
+
+func (p *pathReplacer) replace(in []byte) []byte {
+	matches := pathOnionURLRegex.FindAllIndex(in, -1)
+	var out bytes.Buffer
+	last := 0
+	for _, m := range matches {
+		if m[1] < len(in) && isHostnameChar(in[m[1]]) {
+			// .onion is followed by another label
+			continue
+		}
+		prefix, ok := p.links.rewritePath(string(in[m[0]+2 : m[1]]))
+		if !ok {
+			continue
+		}
+		out.Write(in[last : m[0]+2])
+		out.WriteString(p.links.path.Host)
+		out.WriteString(prefix)
+		last = m[1]
+	}
+	if last == 0 {
+		return in
+	}
+	out.Write(in[last:])
+	return out.Bytes()
+}
+
+// split cuts the body after the last character that can not be part of an
+// onion url
+func (p *pathReplacer) split(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	cut := len(data)
+	for cut > 0 && (isHostnameChar(data[cut-1]) || data[cut-1] == '/' || data[cut-1] == ':') {
+		cut--
+	}
+	if cut == 0 {
+		if len(data) >= maxRewriteTokenSize {
+			// no boundary in sight, give up on this part
+			return len(data), data, nil
+		}
+		// request more data
+		return 0, nil, nil
+	}
+	return cut, data[:cut], nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newPathLinkRewriter returns a rewriter in path mode for a request to
+// testOnionID on proxy.zwiebel
+func newPathLinkRewriter(t *testing.T) *linkRewriter {
+	t.Helper()
+
+	aliases, err := parseAliases(strings.NewReader(fmt.Sprintf("forum %s", testOnionIDOther)))
+	require.Nil(t, err)
+	links := newLinkRewriter("proxy.zwiebel")
+	links.aliases = aliases
+	links.path = &pathRoute{
+		Host:   "proxy.zwiebel",
+		Prefix: fmt.Sprintf("/o/%s", testOnionID),
+	}
+	return links
+}
+
+func TestLinkRewriterPathMode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"absolute", fmt.Sprintf("http://%s.onion/a?b#c", testOnionID), fmt.Sprintf("http://proxy.zwiebel/o/%s/a?b#c", testOnionID)},
+		{"no path", fmt.Sprintf("https://%s.onion", testOnionID), fmt.Sprintf("https://proxy.zwiebel/o/%s/", testOnionID)},
+		{"query only", fmt.Sprintf("http://%s.onion?q=1", testOnionID), fmt.Sprintf("http://proxy.zwiebel/o/%s/?q=1", testOnionID)},
+		{"protocol relative", fmt.Sprintf("//api.%s.onion/x", testOnionID), fmt.Sprintf("//proxy.zwiebel/o/api.%s/x", testOnionID)},
+		{"port", fmt.Sprintf("http://%s.onion:8080/x", testOnionID), fmt.Sprintf("http://proxy.zwiebel/o/%s:8080/x", testOnionID)},
+		{"userinfo", fmt.Sprintf("http://user:pass@%s.onion/", testOnionID), fmt.Sprintf("http://proxy.zwiebel/o/%s/", testOnionID)},
+		{"alias", fmt.Sprintf("http://%s.onion/", testOnionIDOther), "http://proxy.zwiebel/o/forum/"},
+		{"root relative", "/login?next=/", fmt.Sprintf("/o/%s/login?next=/", testOnionID)},
+		{"relative", "login", "login"},
+		{"fragment", "#top", "#top"},
+		{"other host", "https://example.com/", "https://example.com/"},
+		{"backslash", `/\example.com`, `/\example.com`},
+		{"mailto", "mailto:a@b.onion", "mailto:a@b.onion"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.expected, newPathLinkRewriter(t).rewriteURL(tt.input))
+		})
+	}
+}
+
+func TestLinkRewriterPathModeReverse(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"origin", "https://proxy.zwiebel", fmt.Sprintf("https://%s.onion", testOnionID)},
+		{"referer", fmt.Sprintf("https://proxy.zwiebel/o/%s/page?a=b", testOnionID), fmt.Sprintf("https://%s.onion/page?a=b", testOnionID)},
+		{"other service", fmt.Sprintf(`{"url":"http://proxy.zwiebel/o/api.%s:8080/"}`, testOnionIDOther), fmt.Sprintf(`{"url":"http://api.%s.onion:8080/"}`, testOnionIDOther)},
+		{"alias", "http://proxy.zwiebel/o/forum/x", fmt.Sprintf("http://%s.onion/x", testOnionIDOther)},
+		{"uppercase", fmt.Sprintf("HTTP://PROXY.ZWIEBEL/O/%s/", strings.ToUpper(testOnionID)), fmt.Sprintf("HTTP://%s.onion/", testOnionID)},
+		{"other host", "https://proxy.zwiebel.com/o/x/", "https://proxy.zwiebel.com/o/x/"},
+		{"other port", "https://proxy.zwiebel:8443/", "https://proxy.zwiebel:8443/"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.expected, string(newPathLinkRewriter(t).reverse([]byte(tt.input))))
+		})
+	}
+}
+
+func TestPathReplacer(t *testing.T) {
+	t.Parallel()
+
+	input := fmt.Sprintf(`var a = "http://%s.onion/x"; var b = '//api.%s.onion:8080'; var c = "http://x.onion.com/"; // %s.onion`, testOnionID, testOnionIDOther, testOnionID)
+	expected := fmt.Sprintf(`var a = "http://proxy.zwiebel/o/%s/x"; var b = '//proxy.zwiebel/o/api.forum:8080'; var c = "http://x.onion.com/"; // %s.onion`, testOnionID, testOnionID)
+
+	for _, size := range []int{1, 3, 7, 4096} {
+		size := size
+		t.Run(fmt.Sprintf("chunk size %d", size), func(t *testing.T) {
+			t.Parallel()
+
+			replacer := newPathLinkRewriter(t).onionReplacer()
+			reader := newRewriteReader(io.NopCloser(&chunkReader{data: []byte(input), size: size}), replacer.split, replacer.replace)
+			out, err := io.ReadAll(reader)
+			require.Nil(t, err)
+			assert.Equal(t, expected, string(out))
+		})
+	}
+}
+
+func TestRewriteSetCookiePathMode(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		cookie   string
+		expected string
+	}{
+		{"root", "session=abc; Path=/", fmt.Sprintf("session=abc; Path=/o/%s/", testOnionID)},
+		{"path", "session=abc; Path=/admin", fmt.Sprintf("session=abc; Path=/o/%s/admin", testOnionID)},
+		{"no path", "session=abc", "session=abc"},
+		{"domain", fmt.Sprintf("session=abc; Domain=.%s.onion; Path=/", testOnionID), fmt.Sprintf("session=abc; Path=/o/%s/", testOnionID)},
+		{"proxy domain", "session=abc; Domain=proxy.zwiebel; Path=/", fmt.Sprintf("session=abc; Path=/o/%s/", testOnionID)},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			res, ok := rewriteSetCookie(tt.cookie, newPathLinkRewriter(t), "http", fmt.Sprintf("%s.onion", testOnionID))
+			assert.True(t, ok)
+			assert.Equal(t, tt.expected, res)
+		})
+	}
+}
+
+func TestPathHandler(t *testing.T) {
+	t.Parallel()
+
+	const domain = "proxy.zwiebel"
+	tests := []struct {
+		name             string
+		host             string
+		path             string
+		expectedStatus   int
+		expectedHost     string
+		expectedLocation string
+		expectedBody     string
+		unexpectedBody   string
+		expectedCookie   string
+	}{
+		{
+			name:           "page",
+			host:           domain,
+			path:           fmt.Sprintf("/o/%s/dir/page?x=1", testOnionID),
+			expectedStatus: http.StatusOK,
+			expectedHost:   fmt.Sprintf("%s.onion", testOnionID),
+			expectedBody:   fmt.Sprintf(`<a href="/o/%s/a">/dir/page?x=1</a><a href="http://%s/o/%s/b">b</a><img src="c.png">`, testOnionID, domain, testOnionIDOther),
+			expectedCookie: fmt.Sprintf("session=abc; Path=/o/%s/", testOnionID),
+		},
+		{
+			name:           "subdomain and port",
+			host:           domain,
+			path:           fmt.Sprintf("/o/api.%s.onion:8080/", testOnionID),
+			expectedStatus: http.StatusOK,
+			expectedHost:   fmt.Sprintf("api.%s.onion", testOnionID),
+			expectedBody:   `<a href="/o/api.` + testOnionID + `.onion:8080/a">/</a>`,
+		},
+		{
+			name:             "redirect",
+			host:             domain,
+			path:             fmt.Sprintf("/o/%s/redirect", testOnionID),
+			expectedStatus:   http.StatusFound,
+			expectedHost:     fmt.Sprintf("%s.onion", testOnionID),
+			expectedLocation: fmt.Sprintf("/o/%s/login", testOnionID),
+		},
+		{
+			name:             "trailing slash",
+			host:             domain,
+			path:             fmt.Sprintf("/o/%s?x=1", testOnionID),
+			expectedStatus:   http.StatusMovedPermanently,
+			expectedLocation: fmt.Sprintf("/o/%s/?x=1", testOnionID),
+		},
+		{
+			name:           "invalid onion",
+			host:           domain,
+			path:           "/o/asdf/",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid onion address",
+		},
+		{
+			name:           "invalid characters",
+			host:           domain,
+			path:           "/o/a%20b/",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "invalid onion address",
+		},
+		{
+			name:           "markup",
+			host:           domain,
+			path:           "/o/%3Cimg%20src=x%20onerror=alert(1)%3E/",
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   "&lt;img src=x onerror=alert(1)&gt;",
+			unexpectedBody: "<img src=x",
+		},
+		{
+			name:           "subdomain mode",
+			host:           fmt.Sprintf("%s.%s", testOnionID, domain),
+			path:           "/o/other/",
+			expectedStatus: http.StatusOK,
+			expectedHost:   fmt.Sprintf("%s.onion", testOnionID),
+			expectedBody:   `<a href="/a">/o/other/</a>`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/redirect":
+					http.Redirect(w, r, "/login", http.StatusFound)
+				default:
+					http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+					w.Header().Set("Content-Type", "text/html")
+					fmt.Fprintf(w, `<a href="/a">%s</a><a href="http://%s.onion/b">b</a><img src="c.png">`, r.URL.RequestURI(), testOnionIDOther)
+				}
+			}))
+			defer upstream.Close()
+
+			socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+			app := newTestApplication(t, domain, socks.URL())
+			app.pathMode = true
+
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.Host = tt.host
+			w := httptest.NewRecorder()
+			app.routes().ServeHTTP(w, r)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+			if tt.unexpectedBody != "" {
+				assert.NotContains(t, w.Body.String(), tt.unexpectedBody)
+			}
+			assert.Equal(t, tt.expectedLocation, w.Header().Get("Location"))
+			if tt.expectedCookie != "" {
+				assert.Equal(t, tt.expectedCookie, w.Header().Get("Set-Cookie"))
+			}
+			requests := socks.Requests()
+			if tt.expectedHost == "" {
+				assert.Empty(t, requests)
+				return
+			}
+			require.Len(t, requests, 1)
+			assert.Equal(t, tt.expectedHost, requests[0].Host)
+		})
+	}
+}
+
+func TestPathModeDisabled(t *testing.T) {
+	t.Parallel()
+
+	socks := newFakeSOCKSServer(t, "127.0.0.1:1")
+	app := newTestApplication(t, "proxy.zwiebel", socks.URL())
+
+	r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/o/%s/", testOnionID), nil)
+	r.Host = "proxy.zwiebel"
+	w := httptest.NewRecorder()
+	app.routes().ServeHTTP(w, r)
+
+	// the default page of the proxy
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, socks.Requests())
+}
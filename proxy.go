@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"fmt"
 	"io"
 	"net"
@@ -12,6 +10,17 @@ import (
 	"github.com/firefart/zwiebelproxy/antikorpsLogger"
 )
 
+// linkRewriter returns a rewriter mapping onion links to our domain or to
+// paths on the proxy if the request was routed in path mode
+func (app *application) linkRewriter(r *http.Request) *linkRewriter {
+	links := newLinkRewriter(app.requestDomain(r))
+	links.aliases = app.aliases
+	if route, ok := pathRouteFromRequest(r); ok {
+		links.path = &route
+	}
+	return links
+}
+
 // modify the request
 func (app *application) director(r *http.Request) {
 	host, port, err := net.SplitHostPort(r.Host)
@@ -21,17 +30,19 @@ func (app *application) director(r *http.Request) {
 		port = r.URL.Port()
 	}
 
-	domain := app.domain
-	if !strings.HasPrefix(domain, ".") {
-		domain = fmt.Sprintf(".%s", domain)
+	domain := app.requestDomain(r)
+	if _, ok := proxyDomainFromRequest(r); !ok {
+		if d, ok := app.matchDomain(strings.ToLower(host)); ok {
+			domain = d
+		}
 	}
 
-	host = strings.TrimSuffix(host, domain)
-	host = strings.TrimSuffix(host, ".")
-	host = fmt.Sprintf("%s.onion", host)
-	if port != "" && port != "80" && port != "443" {
-		host = net.JoinHostPort(host, port)
+	target, ok := onionTargetFromRequest(r)
+	if !ok {
+		target = newOnionTarget(strings.TrimSuffix(host, domain), port)
 	}
+	host = target.Host()
+	port = target.Port
 
 	scheme := r.URL.Scheme
 	if scheme == "" {
@@ -76,6 +87,27 @@ func (app *application) director(r *http.Request) {
 	}
 	// needed so the ip will not be leaked
 	r.Header["X-Forwarded-For"] = nil
+	removeCookie(r, isolationCookieName)
+	removeCookie(r, authCookieName)
+	if app.userHeader != "" {
+		r.Header.Del(app.userHeader)
+	}
+
+	app.rewriteRequest(r, app.linkRewriter(r))
+
+	// the onion service does not know about the prefix in path mode
+	if _, ok := pathRouteFromRequest(r); ok {
+		stripPathPrefix(r.URL)
+	}
+
+	// only ask for encodings we are able to rewrite
+	if acceptEncoding := r.Header.Get("Accept-Encoding"); acceptEncoding != "" {
+		if filtered := filterAcceptEncoding(acceptEncoding); filtered != "" {
+			r.Header.Set("Accept-Encoding", filtered)
+		} else {
+			r.Header.Del("Accept-Encoding")
+		}
+	}
 
 	r.URL.Scheme = scheme
 	r.URL.Host = host
@@ -110,36 +142,90 @@ func (app *application) director(r *http.Request) {
 
 // modify the response
 func (app *application) proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
-	app.logError(w, err, http.StatusBadGateway)
+	app.recordProxyResult(err)
+	app.proxyError(w, r, err)
 }
 
 // modify the response
 func (app *application) modifyResponse(resp *http.Response) error {
+	app.recordProxyResult(nil)
 	app.logger.Debugf("entered modifyResponse for %s with status %d", sanitizeString(resp.Request.URL.String()), resp.StatusCode)
 	if app.JsonLoggerEnabled {
 		message := fmt.Sprintf("entered modifyResponse for %s with status %d", sanitizeString(resp.Request.URL.String()), resp.StatusCode)
 		app.JsonLogger.DebugLevel(message)
 	}
 
-	domain := app.domain
-	if !strings.HasPrefix(domain, ".") {
-		domain = fmt.Sprintf(".%s", domain)
-	}
+	domain := app.requestDomain(resp.Request)
 
 	app.logger.Debugf("Header: %#v", resp.Header)
 	if app.JsonLoggerEnabled {
 		message := app.JsonLogger.CompactHttpHeader("DEBUG", "Header", resp.Header)
 		app.JsonLogger.WriteToFile(message)
 	}
+	links := app.linkRewriter(resp.Request)
+	scheme := clientScheme(resp.Request)
 	for k, v := range resp.Header {
+		if http.CanonicalHeaderKey(k) == "Set-Cookie" {
+			var cookies []string
+			for _, cookie := range v {
+				if cookie, ok := rewriteSetCookie(cookie, links, scheme, resp.Request.URL.Hostname()); ok {
+					cookies = append(cookies, cookie)
+				}
+			}
+			if len(cookies) == 0 {
+				delete(resp.Header, k)
+			} else {
+				resp.Header[k] = cookies
+			}
+			continue
+		}
+		isLocation := http.CanonicalHeaderKey(k) == "Location" || http.CanonicalHeaderKey(k) == "Content-Location"
 		k = strings.ReplaceAll(k, ".onion", domain)
 		resp.Header[k] = []string{}
 		for _, v2 := range v {
-			v2 = strings.ReplaceAll(v2, ".onion", domain)
+			if isLocation {
+				v2 = links.rewriteLocation(v2)
+			} else {
+				v2 = links.replaceHeader(v2)
+			}
 			resp.Header[k] = append(resp.Header[k], v2)
 		}
 	}
 
+	// the body of an upgraded connection is the raw connection
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		app.logger.Debugf("%s - switching protocols, not attempting to modify body", sanitizeString(resp.Request.URL.String()))
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("%s - switching protocols, not attempting to modify body", sanitizeString(resp.Request.URL.String()))
+			app.JsonLogger.DebugLevel(message)
+		}
+		return nil
+	}
+
+	// HEAD, 204 and 304 responses have no body to decode and must keep their
+	// Content-Length
+	if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		app.logger.Debugf("%s - response without body, not attempting to modify body", sanitizeString(resp.Request.URL.String()))
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("%s - response without body, not attempting to modify body", sanitizeString(resp.Request.URL.String()))
+			app.JsonLogger.DebugLevel(message)
+		}
+		return nil
+	}
+
+	// streams like server sent events only end when the client or the server
+	// closes them so only abort them if no data arrives for the timeout.
+	// Long-polls already use an idle timeout and keep it for the body.
+	if deadline := requestDeadlineFromRequest(resp.Request); deadline != nil && (deadline.isIdle() || isStreamingResponse(resp)) {
+		app.logger.Debugf("%s - detected streaming response, switching to idle timeout", sanitizeString(resp.Request.URL.String()))
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("%s - detected streaming response, switching to idle timeout", sanitizeString(resp.Request.URL.String()))
+			app.JsonLogger.DebugLevel(message)
+		}
+		deadline.switchToIdle()
+		resp.Body = &idleTimeoutReader{ReadCloser: resp.Body, deadline: deadline}
+	}
+
 	// no body modification on file downloads
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Disposition
 	contentDisp, ok := resp.Header["Content-Disposition"]
@@ -167,6 +253,7 @@ func (app *application) modifyResponse(resp *http.Response) error {
 		"application/rss+xml",
 		"application/atom+xml",
 		"application/rdf+xml",
+		"text/event-stream",
 	}
 
 	contentType, ok := resp.Header["Content-Type"]
@@ -179,9 +266,10 @@ func (app *application) modifyResponse(resp *http.Response) error {
 		return nil
 	}
 
+	cleanedUpContentType := ""
 	if ok && len(contentType) > 0 {
 		// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Type
-		cleanedUpContentType := strings.Split(contentType[0], ";")[0]
+		cleanedUpContentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType[0], ";")[0]))
 		if !sliceContains(contentTypesForReplace, cleanedUpContentType) {
 			app.logger.Debugf("%s - content type is %s, not replacing", sanitizeString(resp.Request.URL.String()), cleanedUpContentType)
 			if app.JsonLoggerEnabled {
@@ -198,60 +286,62 @@ func (app *application) modifyResponse(resp *http.Response) error {
 		app.JsonLogger.DebugLevel(message)
 	}
 
-	reader := resp.Body
-	usedGzip := false
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Encoding
-	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
-		app.logger.Debugf("%s - detected gzipped body", sanitizeString(resp.Request.URL.String()))
-		var err error
-		reader, err = gzip.NewReader(resp.Body)
+	contentEncodingHeader := resp.Header.Get("Content-Encoding")
+	encoding, ok := lookupContentEncoding(contentEncodingHeader)
+	if !ok {
+		app.logger.Debugf("%s - content encoding %s is not supported, not replacing", sanitizeString(resp.Request.URL.String()), sanitizeString(contentEncodingHeader))
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("%s - content encoding %s is not supported, not replacing", sanitizeString(resp.Request.URL.String()), sanitizeString(contentEncodingHeader))
+			app.JsonLogger.DebugLevel(message)
+		}
+		return nil
+	}
+
+	var reader io.ReadCloser = resp.Body
+	if encoding != nil {
+		app.logger.Debugf("%s - detected %s encoded body", sanitizeString(resp.Request.URL.String()), sanitizeString(contentEncodingHeader))
+		decoder, err := encoding.newReader(resp.Body)
 		if err != nil {
 			if app.JsonLoggerEnabled {
-				app.JsonLogger.ErrorLevel("could not create gzip reader:" + err.Error())
+				app.JsonLogger.ErrorLevel("could not create decoder:" + err.Error())
 			}
-			return fmt.Errorf("could not create gzip reader: %w", err)
-
+			return fmt.Errorf("could not create %s decoder: %w", sanitizeString(contentEncodingHeader), err)
 		}
-		// resp.Header.Del("Content-Encoding")
-		usedGzip = true
+		reader = &bodyReadCloser{Reader: decoder, closers: []io.Closer{decoder, resp.Body}}
 	}
 
 	// for all other content replace .onion urls with our custom domain
-	body, err := io.ReadAll(reader)
-	if err != nil {
-		if app.JsonLoggerEnabled {
-			app.JsonLogger.ErrorLevel("error on reading body:" + err.Error())
-		}
-		return fmt.Errorf("error on reading body: %w", err)
-	}
-
-	app.logger.Debugf("%s: Got a %d body len", sanitizeString(resp.Request.URL.String()), len(body))
+	// while the body is streamed to the client
+	app.logger.Debugf("%s - streaming body through rewriter", sanitizeString(resp.Request.URL.String()))
 	if app.JsonLoggerEnabled {
-		message := fmt.Sprintf("%s: Got a %d body len", sanitizeString(resp.Request.URL.String()), len(body))
+		message := fmt.Sprintf("%s - streaming body through rewriter", sanitizeString(resp.Request.URL.String()))
 		app.JsonLogger.DebugLevel(message)
 	}
-	// replace stuff for domain replacement
-	body = bytes.ReplaceAll(body, []byte(".onion/"), []byte(fmt.Sprintf("%s/", domain)))
-	body = bytes.ReplaceAll(body, []byte(`.onion"`), []byte(fmt.Sprintf(`%s"`, domain)))
-	body = bytes.ReplaceAll(body, []byte(".onion<"), []byte(fmt.Sprintf("%s<", domain)))
+	switch cleanedUpContentType {
+	case "text/html":
+		reader = newHTMLRewriter(links).rewrite(reader)
+	case "text/event-stream":
+		replacer := links.onionReplacer()
+		reader = newRewriteReader(reader, splitLines, replacer.replace)
+	case "text/css":
+		rewriter := newCSSRewriter(links)
+		reader = newRewriteReader(reader, rewriter.split, rewriter.rewrite)
+	default:
+		replacer := links.onionReplacer()
+		reader = newRewriteReader(reader, replacer.split, replacer.replace)
+	}
 
 	// if we unpacked before, respect the client and repack the modified body (the header is still set)
-	if usedGzip {
-		app.logger.Debugf("%s - re gzipping body", sanitizeString(resp.Request.URL.String()))
-		gzipped, err := gzipInput(body)
-		if err != nil {
-			if app.JsonLoggerEnabled {
-				app.JsonLogger.ErrorLevel("could not gzip body:" + err.Error())
-			}
-			return fmt.Errorf("could not gzip body: %w", err)
-		}
-		body = gzipped
+	if encoding != nil {
+		app.logger.Debugf("%s - re encoding body", sanitizeString(resp.Request.URL.String()))
+		reader = compressStream(reader, encoding.newWriter)
 	}
 
-	// body can be read only once so recreate a new reader
-	resp.Body = io.NopCloser(bytes.NewBuffer(body))
+	resp.Body = reader
 
-	// update the content-length to our new body
-	resp.Header["Content-Length"] = []string{fmt.Sprint(len(body))}
+	// the final length is unknown so send the body chunked
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
 	return nil
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDirector(t *testing.T) {
@@ -25,6 +27,8 @@ func TestDirector(t *testing.T) {
 		{fmt.Sprintf("https://asdf.%s/1234", domain), "", "https", "asdf.onion"},
 		{fmt.Sprintf("http://asdf.%s:8008/1234", domain), "8008", "http", "asdf.onion:8008"},
 		{fmt.Sprintf("https://asdf.%s:8008/1234", domain), "8008", "https", "asdf.onion:8008"},
+		{fmt.Sprintf("http://api.asdf.%s/1234", domain), "", "http", "api.asdf.onion"},
+		{fmt.Sprintf("http://v1.api.asdf.%s:8008/1234", domain), "8008", "http", "v1.api.asdf.onion:8008"},
 	}
 	for _, tt := range tests {
 		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
@@ -37,8 +41,8 @@ func TestDirector(t *testing.T) {
 				return
 			}
 			app := application{
-				domain: domain,
-				logger: &DiscardLogger{},
+				domains: []string{domain},
+				logger:  &DiscardLogger{},
 			}
 			app.director(r)
 			assert.Empty(t, r.Header.Get("X-Forwarded-For"))
@@ -87,8 +91,8 @@ func TestDirectorWebRequest(t *testing.T) {
 			r.Host = tt.host
 
 			app := application{
-				domain: domain,
-				logger: &DiscardLogger{},
+				domains: []string{domain},
+				logger:  &DiscardLogger{},
 			}
 			app.director(r)
 			assert.Empty(t, r.Header.Get("X-Forwarded-For"))
@@ -140,8 +144,8 @@ func TestModifyResponse(t *testing.T) {
 			resp.Body = io.NopCloser(bytes.NewBuffer(tt.body))
 
 			app := application{
-				domain: domain,
-				logger: &DiscardLogger{},
+				domains: []string{domain},
+				logger:  &DiscardLogger{},
 			}
 
 			if err := app.modifyResponse(&resp); err != nil {
@@ -159,3 +163,182 @@ func TestModifyResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestModifyResponseContentEncoding(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	body := []byte(`<a href="http://asdf.onion/index.html">asdf.onion</a>`)
+	expected := []byte(`<a href="http://asdf.xxx.zwiebel/index.html">asdf.xxx.zwiebel</a>`)
+
+	rawDeflate := func(w io.Writer) (flushWriter, error) {
+		return flate.NewWriter(w, flate.DefaultCompression)
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		encode   func(io.Writer) (flushWriter, error)
+	}{
+		{"identity", "", nil},
+		{"gzip", "gzip", contentEncodings["gzip"].newWriter},
+		{"x-gzip", "x-gzip", contentEncodings["gzip"].newWriter},
+		{"deflate", "deflate", contentEncodings["deflate"].newWriter},
+		{"raw deflate", "deflate", rawDeflate},
+		{"brotli", "br", contentEncodings["br"].newWriter},
+		{"zstd", "zstd", contentEncodings["zstd"].newWriter},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			encodedBody := body
+			if tt.encode != nil {
+				var b bytes.Buffer
+				w, err := tt.encode(&b)
+				require.Nil(t, err)
+				_, err = w.Write(body)
+				require.Nil(t, err)
+				require.Nil(t, w.Close())
+				encodedBody = b.Bytes()
+			}
+
+			resp := http.Response{
+				StatusCode: 200,
+				Request: &http.Request{
+					URL: &url.URL{},
+				},
+				Header: make(http.Header),
+				Body:   io.NopCloser(bytes.NewBuffer(encodedBody)),
+			}
+			resp.Header.Set("Content-Type", "text/plain")
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+
+			app := application{
+				domains: []string{domain},
+				logger:  &DiscardLogger{},
+			}
+			require.Nil(t, app.modifyResponse(&resp))
+			defer resp.Body.Close()
+
+			var reader io.Reader = resp.Body
+			if tt.encoding != "" {
+				encoding, ok := lookupContentEncoding(tt.encoding)
+				require.True(t, ok)
+				decoder, err := encoding.newReader(resp.Body)
+				require.Nil(t, err)
+				defer decoder.Close()
+				reader = decoder
+			}
+			modifiedBody, err := io.ReadAll(reader)
+			require.Nil(t, err)
+			assert.Equal(t, string(expected), string(modifiedBody))
+			assert.Equal(t, tt.encoding, resp.Header.Get("Content-Encoding"))
+		})
+	}
+}
+
+func TestModifyResponseWithoutBody(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		method string
+		status int
+	}{
+		{"head", http.MethodHead, http.StatusOK},
+		{"no content", http.MethodGet, http.StatusNoContent},
+		{"not modified", http.MethodGet, http.StatusNotModified},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := http.Response{
+				StatusCode: tt.status,
+				Request: &http.Request{
+					Method: tt.method,
+					URL:    &url.URL{},
+				},
+				Header:        make(http.Header),
+				Body:          http.NoBody,
+				ContentLength: 1234,
+			}
+			resp.Header.Set("Content-Type", "text/html")
+			resp.Header.Set("Content-Encoding", "gzip")
+			resp.Header.Set("Content-Length", "1234")
+
+			app := application{
+				domains: []string{"xxx.zwiebel"},
+				logger:  &DiscardLogger{},
+			}
+			require.Nil(t, app.modifyResponse(&resp))
+			assert.Equal(t, int64(1234), resp.ContentLength)
+			assert.Equal(t, "1234", resp.Header.Get("Content-Length"))
+			assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		})
+	}
+}
+
+func TestModifyResponseUnsupportedEncoding(t *testing.T) {
+	t.Parallel()
+
+	body := []byte("not really compressed asdf.onion/")
+	resp := http.Response{
+		StatusCode: 200,
+		Request: &http.Request{
+			URL: &url.URL{},
+		},
+		Header: make(http.Header),
+		Body:   io.NopCloser(bytes.NewBuffer(body)),
+	}
+	resp.Header.Set("Content-Type", "text/html")
+	resp.Header.Set("Content-Encoding", "compress")
+
+	app := application{
+		domains: []string{"xxx.zwiebel"},
+		logger:  &DiscardLogger{},
+	}
+	require.Nil(t, app.modifyResponse(&resp))
+	modifiedBody, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	assert.Equal(t, body, modifiedBody)
+}
+
+func TestDirectorAcceptEncoding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br, zstd", "gzip, deflate, br, zstd"},
+		{"gzip;q=1.0, compress;q=0.5, identity", "gzip;q=1.0, identity"},
+		{"compress", ""},
+		{"*", ""},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := http.NewRequest(http.MethodGet, "http://asdf.onion.zwiebel/", nil)
+			require.Nil(t, err)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			app := application{
+				domains: []string{"onion.zwiebel"},
+				logger:  &DiscardLogger{},
+			}
+			app.director(r)
+			assert.Equal(t, tt.expected, r.Header.Get("Accept-Encoding"))
+		})
+	}
+}
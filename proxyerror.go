@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// errRequestTimeout is the cause of requests canceled by the timeout
+var errRequestTimeout = errors.New("the request timed out")
+
+// errorKind describes a class of errors for the error page. Code is stable
+// and can be used by scripts, it is also sent in the X-Zwiebelproxy-Error
+// header.
+type errorKind struct {
+	Code        string
+	Title       string
+	Explanation string
+	StatusCode  int
+}
+
+var (
+	errorKindProxy = errorKind{
+		Code:        "proxy_error",
+		Title:       "The request could not be proxied",
+		Explanation: "An unexpected error occurred while talking to the onion service.",
+		StatusCode:  http.StatusBadGateway,
+	}
+	errorKindTimeout = errorKind{
+		Code:        "timeout",
+		Title:       "The onion service did not answer in time",
+		Explanation: "The service or the TOR circuit is slow or overloaded. Please try again later.",
+		StatusCode:  http.StatusGatewayTimeout,
+	}
+	errorKindTorUnavailable = errorKind{
+		Code:        "tor_unavailable",
+		Title:       "TOR is not available",
+		Explanation: "The proxy could not connect to its TOR daemon. Please try again later.",
+		StatusCode:  http.StatusServiceUnavailable,
+	}
+	errorKindTLSPin = errorKind{
+		Code:        "tls_pin_mismatch",
+		Title:       "The certificate of the onion service changed",
+		Explanation: "The certificate does not match the public keys pinned for this service on the proxy. The connection may be intercepted.",
+		StatusCode:  http.StatusBadGateway,
+	}
+	errorKindTLSVerification = errorKind{
+		Code:        "tls_verification_failed",
+		Title:       "The certificate of the onion service is not trusted",
+		Explanation: "The proxy is configured to verify the certificate of this service and the verification failed.",
+		StatusCode:  http.StatusBadGateway,
+	}
+)
+
+// socksErrorKinds maps SOCKS reply codes to error kinds
+var socksErrorKinds = map[byte]errorKind{
+	0x01: {
+		Code:        "tor_general_failure",
+		Title:       "TOR could not reach the onion service",
+		Explanation: "TOR reported a general failure, often the descriptor of the service could not be fetched yet. Please try again in a few seconds.",
+		StatusCode:  http.StatusBadGateway,
+	},
+	0x02: {
+		Code:        "tor_not_allowed",
+		Title:       "TOR refused the connection",
+		Explanation: "The configuration of the TOR daemon does not allow this connection.",
+		StatusCode:  http.StatusBadGateway,
+	},
+	0x03: {
+		Code:        "tor_network_unreachable",
+		Title:       "The TOR network is unreachable",
+		Explanation: "TOR could not build a circuit. Please try again later.",
+		StatusCode:  http.StatusBadGateway,
+	},
+	0x04: {
+		Code:        "onion_unreachable",
+		Title:       "The onion service is unreachable",
+		Explanation: "TOR could not connect to the service. It may be offline or the descriptor could not be fetched.",
+		StatusCode:  http.StatusBadGateway,
+	},
+	0x05: {
+		Code:        "connection_refused",
+		Title:       "The onion service refused the connection",
+		Explanation: "The service is online but does not accept connections on this port.",
+		StatusCode:  http.StatusBadGateway,
+	},
+	0x06: {
+		Code:        "tor_ttl_expired",
+		Title:       "The connection to the onion service timed out",
+		Explanation: "TOR gave up connecting to the service. Please try again later.",
+		StatusCode:  http.StatusGatewayTimeout,
+	},
+	0x07: {
+		Code:        "tor_unsupported",
+		Title:       "TOR does not support the request",
+		Explanation: "The TOR daemon does not support the SOCKS command used by the proxy.",
+		StatusCode:  http.StatusBadGateway,
+	},
+	0x08: {
+		Code:        "tor_unsupported",
+		Title:       "TOR does not support the request",
+		Explanation: "The TOR daemon does not support the address type used by the proxy.",
+		StatusCode:  http.StatusBadGateway,
+	},
+	0xf0: {
+		Code:        "onion_not_found",
+		Title:       "The onion service does not exist",
+		Explanation: "TOR could not find a descriptor for this address. The service is offline or never existed.",
+		StatusCode:  http.StatusNotFound,
+	},
+	0xf1: {
+		Code:        "onion_descriptor_invalid",
+		Title:       "The onion service is broken",
+		Explanation: "The descriptor of the service could not be decoded.",
+		StatusCode:  http.StatusBadGateway,
+	},
+	0xf2: {
+		Code:        "onion_introduction_failed",
+		Title:       "The onion service could not be introduced",
+		Explanation: "All introduction points of the service failed. The service may be overloaded or offline.",
+		StatusCode:  http.StatusBadGateway,
+	},
+	0xf3: {
+		Code:        "onion_rendezvous_failed",
+		Title:       "The onion service did not complete the rendezvous",
+		Explanation: "The service could not be reached at the rendezvous point. Please try again.",
+		StatusCode:  http.StatusBadGateway,
+	},
+	0xf4: {
+		Code:        "onion_client_auth_missing",
+		Title:       "The onion service requires client authorization",
+		Explanation: "The proxy has no client authorization key for this service.",
+		StatusCode:  http.StatusForbidden,
+	},
+	0xf5: {
+		Code:        "onion_client_auth_invalid",
+		Title:       "The client authorization was rejected",
+		Explanation: "The client authorization key of the proxy for this service is wrong.",
+		StatusCode:  http.StatusForbidden,
+	},
+	0xf6: {
+		Code:        "onion_address_invalid",
+		Title:       "The onion address is invalid",
+		Explanation: "TOR rejected the address, please check it for typos.",
+		StatusCode:  http.StatusBadRequest,
+	},
+	0xf7: {
+		Code:        "onion_introduction_timeout",
+		Title:       "The onion service did not answer in time",
+		Explanation: "The introduction to the service timed out. It may be overloaded, please try again later.",
+		StatusCode:  http.StatusGatewayTimeout,
+	},
+}
+
+// proxyError renders the error page for an error returned by the transport
+func (app *application) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(context.Cause(r.Context()), errRequestTimeout) {
+		err = fmt.Errorf("%w: %v", errRequestTimeout, err)
+	}
+	if se, ok := parseSOCKSError(err); ok && !errors.Is(err, se) {
+		err = se
+	}
+	kind := classifyProxyError(err)
+
+	app.logger.Errorf("%s: %v", kind.Code, err)
+	if app.JsonLoggerEnabled {
+		message := fmt.Sprintf("%s: %v", kind.Code, err)
+		app.JsonLogger.DebugLevel(message)
+	}
+
+	w.Header().Set("X-Zwiebelproxy-Error", kind.Code)
+	app.renderError(w, kind.StatusCode, errorPage{
+		Error:       err.Error(),
+		Code:        kind.Code,
+		Title:       kind.Title,
+		Explanation: kind.Explanation,
+	})
+}
+
+// classifyProxyError returns the kind of an error returned by the transport
+func classifyProxyError(err error) errorKind {
+	if se, ok := parseSOCKSError(err); ok {
+		if kind, ok := socksErrorKinds[se.Code]; ok {
+			return kind
+		}
+		return errorKindProxy
+	}
+
+	var pinErr *tlsPinError
+	if errors.As(err, &pinErr) {
+		return errorKindTLSPin
+	}
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateErr x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &certificateErr) {
+		return errorKindTLSVerification
+	}
+
+	if isTorDialError(err) {
+		return errorKindTorUnavailable
+	}
+
+	var netErr net.Error
+	if errors.Is(err, errRequestTimeout) || errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return errorKindTimeout
+	}
+	return errorKindProxy
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyProxyError(t *testing.T) {
+	t.Parallel()
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}
+	socksErr := func(msg string) error {
+		return &net.OpError{Op: "socks connect", Addr: addr, Err: errors.New(msg)}
+	}
+	tests := []struct {
+		name           string
+		err            error
+		expectedCode   string
+		expectedStatus int
+	}{
+		{"general failure", socksErr("unknown error general SOCKS server failure"), "tor_general_failure", http.StatusBadGateway},
+		{"host unreachable", socksErr("unknown error host unreachable"), "onion_unreachable", http.StatusBadGateway},
+		{"connection refused", socksErr("unknown error connection refused"), "connection_refused", http.StatusBadGateway},
+		{"TTL expired", socksErr("unknown error TTL expired"), "tor_ttl_expired", http.StatusGatewayTimeout},
+		{"descriptor not found", socksErr("unknown error unknown code: 240"), "onion_not_found", http.StatusNotFound},
+		{"introduction failed", socksErr("unknown error unknown code: 242"), "onion_introduction_failed", http.StatusBadGateway},
+		{"rendezvous failed", socksErr("unknown error unknown code: 243"), "onion_rendezvous_failed", http.StatusBadGateway},
+		{"client auth missing", socksErr("unknown error unknown code: 244"), "onion_client_auth_missing", http.StatusForbidden},
+		{"bad address", socksErr("unknown error unknown code: 246"), "onion_address_invalid", http.StatusBadRequest},
+		{"introduction timeout", socksErr("unknown error unknown code: 247"), "onion_introduction_timeout", http.StatusGatewayTimeout},
+		{"unknown reply", socksErr("unknown error unknown code: 9"), "proxy_error", http.StatusBadGateway},
+		{"retried", fmt.Errorf("%w, gave up after 3 attempts", socksErr("unknown error unknown code: 240")), "onion_not_found", http.StatusNotFound},
+		{"tor unavailable", &net.OpError{Op: "proxyconnect", Net: "tcp", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, "tor_unavailable", http.StatusServiceUnavailable},
+		{"pin mismatch", &tlsPinError{Host: "test.onion"}, "tls_pin_mismatch", http.StatusBadGateway},
+		{"verification failed", fmt.Errorf("could not verify: %w", x509.UnknownAuthorityError{}), "tls_verification_failed", http.StatusBadGateway},
+		{"request timeout", fmt.Errorf("%w: context canceled", errRequestTimeout), "timeout", http.StatusGatewayTimeout},
+		{"deadline", context.DeadlineExceeded, "timeout", http.StatusGatewayTimeout},
+		{"other", errors.New("EOF"), "proxy_error", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			kind := classifyProxyError(tt.err)
+			assert.Equal(t, tt.expectedCode, kind.Code)
+			assert.Equal(t, tt.expectedStatus, kind.StatusCode)
+			assert.NotEmpty(t, kind.Title)
+			assert.NotEmpty(t, kind.Explanation)
+		})
+	}
+}
+
+func TestProxyErrorPage(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		name           string
+		reply          byte
+		deadSOCKS      bool
+		slowUpstream   bool
+		expectedStatus int
+		expectedCode   string
+		expectedText   string
+	}{
+		{"descriptor not found", 0xf0, false, false, http.StatusNotFound, "onion_not_found", "The onion service does not exist"},
+		{"client auth missing", 0xf4, false, false, http.StatusForbidden, "onion_client_auth_missing", "The onion service requires client authorization"},
+		{"tor unavailable", 0, true, false, http.StatusServiceUnavailable, "tor_unavailable", "TOR is not available"},
+		{"timeout", 0, false, true, http.StatusGatewayTimeout, "timeout", "The onion service did not answer in time"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.slowUpstream {
+					select {
+					case <-r.Context().Done():
+					case <-time.After(5 * time.Second):
+					}
+				}
+				fmt.Fprint(w, "ok")
+			}))
+			defer upstream.Close()
+
+			socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+			socks.setReply(tt.reply)
+			socksURL := socks.URL()
+			if tt.deadSOCKS {
+				socksURL = fmt.Sprintf("socks5://%s", closedAddress(t))
+			}
+			app := newTestApplication(t, domain, socksURL)
+			if tt.slowUpstream {
+				app.timeout = 100 * time.Millisecond
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = fmt.Sprintf("%s.%s", testOnionID, domain)
+			w := httptest.NewRecorder()
+			app.routes().ServeHTTP(w, r)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.Equal(t, tt.expectedCode, w.Header().Get("X-Zwiebelproxy-Error"))
+			assert.Contains(t, w.Body.String(), tt.expectedText)
+			assert.Contains(t, w.Body.String(), fmt.Sprintf(`<code class="error-code">%s</code>`, tt.expectedCode))
+			assert.Contains(t, w.Body.String(), fmt.Sprintf(`<meta name="zwiebelproxy-error" content="%s">`, tt.expectedCode))
+		})
+	}
+}
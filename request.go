@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// maxRequestBodyRewriteSize is the maximum size of a request body we buffer
+// to map our domain back to the onion domain
+const maxRequestBodyRewriteSize = 1024 * 1024
+
+// content types of request bodies that can contain absolute urls
+var requestContentTypesForReplace = []string{
+	"application/x-www-form-urlencoded",
+	"application/json",
+}
+
+// rewriteRequest maps our domain back to the onion domain in headers and
+// bodies sent by the client, so CSRF checks on the hidden service succeed
+func (app *application) rewriteRequest(r *http.Request, links *linkRewriter) {
+	for _, header := range []string{"Origin", "Referer"} {
+		if value := r.Header.Get(header); value != "" {
+			r.Header.Set(header, string(links.reverse([]byte(value))))
+		}
+	}
+
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return
+	}
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !sliceContains(requestContentTypesForReplace, contentType) {
+		return
+	}
+
+	if r.ContentLength > maxRequestBodyRewriteSize {
+		app.logger.Debugf("request body of %d bytes is too large to rewrite", r.ContentLength)
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("request body of %d bytes is too large to rewrite", r.ContentLength)
+			app.JsonLogger.DebugLevel(message)
+		}
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodyRewriteSize+1))
+	if err != nil || len(body) > maxRequestBodyRewriteSize {
+		// pass the body on as is, errors will surface when the transport reads it
+		r.Body = &bodyReadCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), closers: []io.Closer{r.Body}}
+		return
+	}
+	if err := r.Body.Close(); err != nil {
+		app.logger.Debugf("could not close request body: %v", err)
+	}
+
+	body = links.reverse(body)
+	app.logger.Debugf("rewrote %s request body, new length %d", contentType, len(body))
+	if app.JsonLoggerEnabled {
+		message := fmt.Sprintf("rewrote %s request body, new length %d", contentType, len(body))
+		app.JsonLogger.DebugLevel(message)
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.TransferEncoding = nil
+}
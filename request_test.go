@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkRewriterReverse(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"http://asdf.onion.zwiebel", "http://asdf.onion"},
+		{"http://asdf.onion.zwiebel:8080/x", "http://asdf.onion:8080/x"},
+		{"https://ASDF.ONION.ZWIEBEL/", "https://ASDF.onion/"},
+		{"http://onion.zwiebel/", "http://onion.zwiebel/"},
+		{"http://asdf.onion.zwiebel.com/", "http://asdf.onion.zwiebel.com/"},
+		{"http://asdf.onion.zwiebelx/", "http://asdf.onion.zwiebelx/"},
+		{"url=http%3A%2F%2Fasdf.onion.zwiebel%2Fa&b=c.onion.zwiebel", "url=http%3A%2F%2Fasdf.onion%2Fa&b=c.onion"},
+		{`{"u":"http:\/\/asdf.onion.zwiebel\/a"}`, `{"u":"http:\/\/asdf.onion\/a"}`},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.input, func(t *testing.T) {
+			t.Parallel()
+
+			res := newLinkRewriter("onion.zwiebel").reverse([]byte(tt.input))
+			assert.Equal(t, tt.expected, string(res))
+		})
+	}
+}
+
+func TestDirectorRewritesRequest(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		name         string
+		contentType  string
+		body         string
+		expectedBody string
+	}{
+		{"urlencoded", "application/x-www-form-urlencoded", "next=http%3A%2F%2Fasdf.onion.zwiebel%2Fhome&x=1", "next=http%3A%2F%2Fasdf.onion%2Fhome&x=1"},
+		{"json", "application/json; charset=utf-8", `{"redirect":"http://asdf.onion.zwiebel/home"}`, `{"redirect":"http://asdf.onion/home"}`},
+		{"multipart", "multipart/form-data; boundary=x", "http://asdf.onion.zwiebel/", "http://asdf.onion.zwiebel/"},
+		{"too large", "application/json", strings.Repeat("a", maxRequestBodyRewriteSize) + "asdf.onion.zwiebel", strings.Repeat("a", maxRequestBodyRewriteSize) + "asdf.onion.zwiebel"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		for _, knownLength := range []bool{true, false} {
+			knownLength := knownLength
+			t.Run(fmt.Sprintf("%s/%t", tt.name, knownLength), func(t *testing.T) {
+				t.Parallel()
+
+				r, err := http.NewRequest(http.MethodPost, "http://asdf.onion.zwiebel/login", bytes.NewBufferString(tt.body))
+				require.Nil(t, err)
+				if !knownLength {
+					r.Body = io.NopCloser(bytes.NewBufferString(tt.body))
+					r.ContentLength = -1
+				}
+				r.Header.Set("Content-Type", tt.contentType)
+				r.Header.Set("Origin", "http://asdf.onion.zwiebel")
+				r.Header.Set("Referer", "http://asdf.onion.zwiebel/login?x=1")
+
+				app := application{
+					domains: []string{domain},
+					logger:  &DiscardLogger{},
+				}
+				app.director(r)
+				assert.Equal(t, "http://asdf.onion", r.Header.Get("Origin"))
+				assert.Equal(t, "http://asdf.onion/login?x=1", r.Header.Get("Referer"))
+
+				body, err := io.ReadAll(r.Body)
+				require.Nil(t, err)
+				assert.Equal(t, tt.expectedBody, string(body))
+				if knownLength || tt.body != tt.expectedBody {
+					assert.Equal(t, int64(len(tt.expectedBody)), r.ContentLength)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRetryBackoff caps the exponential backoff between two attempts
+const maxRetryBackoff = 10 * time.Second
+
+// socksReplies are the SOCKS5 reply codes. Codes 0xf0 and above are sent by
+// TOR for onion services if ExtendedErrors is set on the SocksPort.
+// https://www.rfc-editor.org/rfc/rfc1928#section-6
+// https://spec.torproject.org/socks-extensions.html#extended-error-codes
+var socksReplies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+	0xf0: "onion service descriptor can not be found",
+	0xf1: "onion service descriptor is invalid",
+	0xf2: "onion service introduction failed",
+	0xf3: "onion service rendezvous failed",
+	0xf4: "onion service missing client authorization",
+	0xf5: "onion service wrong client authorization",
+	0xf6: "onion service invalid address",
+	0xf7: "onion service introduction timed out",
+}
+
+// socksError is a failed SOCKS CONNECT
+type socksError struct {
+	Code    byte
+	Address string
+	Err     error
+}
+
+func (e *socksError) Error() string {
+	return fmt.Sprintf("TOR could not connect to %s: %s (SOCKS reply 0x%02x)", e.Address, e.Reply(), e.Code)
+}
+
+func (e *socksError) Unwrap() error {
+	return e.Err
+}
+
+// Reply returns the description of the reply code
+func (e *socksError) Reply() string {
+	if reply, ok := socksReplies[e.Code]; ok {
+		return reply
+	}
+	return "unknown error"
+}
+
+// temporary reports if another attempt can succeed. Descriptor fetches and
+// circuits fail regularly, while a refused connection means the onion
+// service is up but does not listen on the port.
+func (e *socksError) temporary() bool {
+	switch e.Code {
+	case 0x01, 0x03, 0x04, 0x06, 0xf0, 0xf2, 0xf3, 0xf7:
+		return true
+	default:
+		return false
+	}
+}
+
+// circuitFailure reports if TOR itself failed to build a circuit. The
+// onion service specific replies say nothing about the state of TOR.
+func (e *socksError) circuitFailure() bool {
+	switch e.Code {
+	case 0x01, 0x03, 0x06:
+		return true
+	default:
+		return false
+	}
+}
+
+// parseSOCKSError extracts the reply code from the errors of the SOCKS client
+// of net/http, which only returns the description of the code
+func parseSOCKSError(err error) (*socksError, bool) {
+	var se *socksError
+	if errors.As(err, &se) {
+		return se, true
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || !strings.HasPrefix(opErr.Op, "socks") || opErr.Err == nil {
+		return nil, false
+	}
+	msg, ok := strings.CutPrefix(opErr.Err.Error(), "unknown error ")
+	if !ok {
+		return nil, false
+	}
+	se = &socksError{Err: err}
+	if opErr.Addr != nil {
+		se.Address = opErr.Addr.String()
+	}
+	if code, ok := strings.CutPrefix(msg, "unknown code: "); ok {
+		c, err := strconv.Atoi(code)
+		if err != nil || c < 0 || c > 0xff {
+			return nil, false
+		}
+		se.Code = byte(c)
+		return se, true
+	}
+	for code, reply := range socksReplies {
+		if reply == msg {
+			se.Code = code
+			return se, true
+		}
+	}
+	return nil, false
+}
+
+// isRetryable reports if a failed request can be sent again. Only errors
+// occurring before the request reached the onion service are retried.
+func isRetryable(err error) bool {
+	if se, ok := parseSOCKSError(err); ok {
+		return se.temporary()
+	}
+	// the next attempt may use a different backend
+	return isTorDialError(err)
+}
+
+// isTorDialError reports if the TOR proxy itself could not be reached.
+// net/http reports this as proxyconnect error.
+func isTorDialError(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || (opErr.Op != "proxyconnect" && !strings.HasPrefix(opErr.Op, "socks")) {
+		return false
+	}
+	var dialErr *net.OpError
+	return errors.As(opErr.Err, &dialErr) && dialErr.Op == "dial"
+}
+
+// isIdempotent reports if a request can be sent again without side effects
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return r.Body == nil || r.Body == http.NoBody
+	default:
+		return false
+	}
+}
+
+// retryBackoff returns the delay before the attempt, it doubles with every
+// attempt
+func retryBackoff(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay
+}
+
+// retryTransport retries idempotent requests failing with a temporary TOR
+// error
+type retryTransport struct {
+	app  *application
+	next http.RoundTripper
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(r)
+	if err == nil || !isIdempotent(r) {
+		return resp, err
+	}
+
+	attempts := 1
+	for ; attempts <= t.app.retries && isRetryable(err); attempts++ {
+		delay := retryBackoff(t.app.retryBackoff, attempts)
+		t.app.logger.Infof("retrying request to %s in %s (%d/%d): %v", sanitizeString(r.URL.Host), delay, attempts, t.app.retries, err)
+		if t.app.JsonLoggerEnabled {
+			message := fmt.Sprintf("retrying request to %s in %s (%d/%d): %v", sanitizeString(r.URL.Host), delay, attempts, t.app.retries, err)
+			t.app.JsonLogger.DebugLevel(message)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+
+		req := r
+		if t.app.retryNewCircuit {
+			req = withCircuit(r, randomToken())
+		}
+		resp, err = t.next.RoundTrip(req)
+		if err == nil {
+			return resp, nil
+		}
+	}
+
+	if se, ok := parseSOCKSError(err); ok {
+		err = se
+	}
+	if attempts > 1 {
+		err = fmt.Errorf("%w, gave up after %d attempts", err, attempts)
+	}
+	return nil, err
+}
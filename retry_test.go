@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSOCKSError(t *testing.T) {
+	t.Parallel()
+
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}
+	tests := []struct {
+		name      string
+		err       error
+		code      byte
+		ok        bool
+		retryable bool
+	}{
+		{"general failure", &net.OpError{Op: "socks connect", Addr: addr, Err: errors.New("unknown error general SOCKS server failure")}, 0x01, true, true},
+		{"host unreachable", &net.OpError{Op: "socks connect", Addr: addr, Err: errors.New("unknown error host unreachable")}, 0x04, true, true},
+		{"connection refused", &net.OpError{Op: "socks connect", Addr: addr, Err: errors.New("unknown error connection refused")}, 0x05, true, false},
+		{"TTL expired", &net.OpError{Op: "socks connect", Addr: addr, Err: errors.New("unknown error TTL expired")}, 0x06, true, true},
+		{"descriptor not found", &net.OpError{Op: "socks connect", Addr: addr, Err: errors.New("unknown error unknown code: 240")}, 0xf0, true, true},
+		{"wrong client authorization", &net.OpError{Op: "socks connect", Addr: addr, Err: errors.New("unknown error unknown code: 245")}, 0xf5, true, false},
+		{"wrapped", fmt.Errorf("wrapped: %w", &net.OpError{Op: "socks connect", Addr: addr, Err: errors.New("unknown error host unreachable")}), 0x04, true, true},
+		{"proxy unreachable", &net.OpError{Op: "proxyconnect", Net: "tcp", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, 0, false, true},
+		{"proxy unreachable in handshake", &net.OpError{Op: "socks connect", Addr: addr, Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, 0, false, true},
+		{"other error", errors.New("unknown error host unreachable"), 0, false, false},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			se, ok := parseSOCKSError(tt.err)
+			assert.Equal(t, tt.ok, ok)
+			if ok {
+				assert.Equal(t, tt.code, se.Code)
+				assert.Equal(t, "127.0.0.1:80", se.Address)
+				assert.ErrorIs(t, se, tt.err)
+			}
+			assert.Equal(t, tt.retryable, isRetryable(tt.err))
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, 500*time.Millisecond, retryBackoff(500*time.Millisecond, 1))
+	assert.Equal(t, 1*time.Second, retryBackoff(500*time.Millisecond, 2))
+	assert.Equal(t, 2*time.Second, retryBackoff(500*time.Millisecond, 3))
+	assert.Equal(t, maxRetryBackoff, retryBackoff(500*time.Millisecond, 100))
+	assert.Equal(t, maxRetryBackoff, retryBackoff(time.Minute, 1))
+}
+
+func TestIsIdempotent(t *testing.T) {
+	t.Parallel()
+
+	assert.True(t, isIdempotent(httptest.NewRequest(http.MethodGet, "/", nil)))
+	assert.True(t, isIdempotent(httptest.NewRequest(http.MethodHead, "/", nil)))
+	assert.True(t, isIdempotent(httptest.NewRequest(http.MethodOptions, "/", nil)))
+	assert.False(t, isIdempotent(httptest.NewRequest(http.MethodPost, "/", nil)))
+	r, err := http.NewRequest(http.MethodGet, "/", strings.NewReader("body"))
+	require.Nil(t, err)
+	assert.False(t, isIdempotent(r))
+}
+
+func TestRetryTransport(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		name             string
+		method           string
+		replies          []byte
+		reply            byte
+		newCircuit       bool
+		expectedStatus   int
+		expectedRequests int
+		expectedError    string
+	}{
+		{"no error", http.MethodGet, nil, 0, false, http.StatusOK, 1, ""},
+		{"temporary errors", http.MethodGet, []byte{1, 6}, 0, false, http.StatusOK, 3, ""},
+		{"new circuits", http.MethodGet, []byte{4, 0xf0}, 0, true, http.StatusOK, 3, ""},
+		{"connection refused", http.MethodGet, nil, 5, false, http.StatusBadGateway, 1, "connection refused (SOCKS reply 0x05)"},
+		{"post", http.MethodPost, []byte{4}, 0, false, http.StatusBadGateway, 1, "host unreachable (SOCKS reply 0x04)"},
+		{"gave up", http.MethodGet, nil, 4, false, http.StatusBadGateway, 3, "host unreachable (SOCKS reply 0x04), gave up after 3 attempts"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "ok")
+			}))
+			defer upstream.Close()
+
+			socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+			socks.setReply(tt.reply)
+			socks.setReplies(tt.replies...)
+			app := newTestApplication(t, domain, socks.URL())
+			app.transport.Proxy = socksProxy(app.transport.Proxy, "")
+			app.retries = 2
+			app.retryBackoff = time.Millisecond
+			app.retryNewCircuit = tt.newCircuit
+
+			r := httptest.NewRequest(tt.method, "/", nil)
+			r.Host = fmt.Sprintf("%s.%s", testOnionID, domain)
+			w := httptest.NewRecorder()
+			app.routes().ServeHTTP(w, r)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedError != "" {
+				assert.Contains(t, w.Body.String(), tt.expectedError)
+				assert.Contains(t, w.Body.String(), fmt.Sprintf("TOR could not connect to %s.onion:80", testOnionID))
+			} else {
+				assert.Equal(t, "ok", w.Body.String())
+			}
+
+			requests := socks.Requests()
+			require.Len(t, requests, tt.expectedRequests)
+			passwords := make(map[string]bool)
+			for _, request := range requests {
+				passwords[request.Password] = true
+			}
+			if tt.newCircuit {
+				// the first attempt uses the default circuit
+				assert.Equal(t, "", requests[0].Username)
+				assert.Equal(t, "zwiebelproxy", requests[1].Username)
+				assert.Len(t, passwords, tt.expectedRequests)
+			} else {
+				assert.Len(t, passwords, 1)
+			}
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// maxRewriteTokenSize is the maximum amount of bytes a split function can
+// hold back before a token needs to be emitted
+const maxRewriteTokenSize = 1024 * 1024
+
+// rewriteReader streams the body through a bufio.Scanner and rewrites every
+// token returned by the split function. The split function is responsible for
+// never cutting a pattern in half so the rewrite function can work on
+// complete tokens.
+type rewriteReader struct {
+	src     io.ReadCloser
+	scanner *bufio.Scanner
+	rewrite func([]byte) []byte
+	pending []byte
+}
+
+func newRewriteReader(src io.ReadCloser, split bufio.SplitFunc, rewrite func([]byte) []byte) *rewriteReader {
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 4096), maxRewriteTokenSize)
+	scanner.Split(split)
+	return &rewriteReader{
+		src:     src,
+		scanner: scanner,
+		rewrite: rewrite,
+	}
+}
+
+func (r *rewriteReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if !r.scanner.Scan() {
+			if err := r.scanner.Err(); err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		r.pending = r.rewrite(r.scanner.Bytes())
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *rewriteReader) Close() error {
+	return r.src.Close()
+}
+
+// bodyReplacer rewrites onion links in bodies we can not parse. The split
+// function never cuts a link in half.
+type bodyReplacer interface {
+	replace(in []byte) []byte
+	split(data []byte, atEOF bool) (int, []byte, error)
+}
+
+// onionReplacer replaces .onion hostnames with our own domain
+type onionReplacer struct {
+	old    [][]byte
+	new    [][]byte
+	maxLen int
+}
+
+// characters following .onion that are replaced in bodies we can not parse
+var onionReplacerSuffixes = []string{"/", `"`, "<"}
+
+func newOnionReplacer(domain string) bodyReplacer {
+	return newLinkRewriter(domain).onionReplacer()
+}
+
+func (r *onionReplacer) add(old, new []byte) {
+	r.old = append(r.old, old)
+	r.new = append(r.new, new)
+	if len(old) > r.maxLen {
+		r.maxLen = len(old)
+	}
+}
+
+func (r *onionReplacer) replace(in []byte) []byte {
+	out := in
+	for i := range r.old {
+		out = bytes.ReplaceAll(out, r.old[i], r.new[i])
+	}
+	return out
+}
+
+// split returns everything that can not be part of a partial match at the end
+// of the buffer. Matches that cross the cut are included completely.
+func (r *onionReplacer) split(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	cut := len(data) - (r.maxLen - 1)
+	if cut <= 0 {
+		// request more data
+		return 0, nil, nil
+	}
+
+	for moved := true; moved; {
+		moved = false
+		for _, pattern := range r.old {
+			start := cut - len(pattern) + 1
+			if start < 0 {
+				start = 0
+			}
+			i := bytes.Index(data[start:], pattern)
+			if i < 0 || start+i >= cut {
+				continue
+			}
+			if end := start + i + len(pattern); end > cut {
+				cut = end
+				moved = true
+			}
+		}
+	}
+
+	return cut, data[:cut], nil
+}
+
+// bodyReadCloser combines a reader with the closer of the original body
+type bodyReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *bodyReadCloser) Close() error {
+	var err error
+	for _, c := range b.closers {
+		if err2 := c.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+type flushWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressStream pipes src through the writer returned by newWriter. Every
+// chunk read from src is flushed to the output so the client receives the
+// data as soon as it arrives from the hidden service.
+func compressStream(src io.ReadCloser, newWriter func(io.Writer) (flushWriter, error)) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := newWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				if _, err2 := w.Write(buf[:n]); err2 != nil {
+					pw.CloseWithError(err2)
+					return
+				}
+				if err2 := w.Flush(); err2 != nil {
+					pw.CloseWithError(err2)
+					return
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	return &bodyReadCloser{Reader: pr, closers: []io.Closer{pr, src}}
+}
+
+// linkRewriter maps links pointing to onion services to our domain
+type linkRewriter struct {
+	domain  string
+	aliases *aliasTable
+	// path is set in path mode, links are mapped to paths on the proxy
+	// instead of subdomains
+	path *pathRoute
+}
+
+func newLinkRewriter(domain string) *linkRewriter {
+	if !strings.HasPrefix(domain, ".") {
+		domain = fmt.Sprintf(".%s", domain)
+	}
+	return &linkRewriter{
+		domain: domain,
+	}
+}
+
+// rewriteHost returns the host on our domain for an onion host. The host may
+// contain a port. The second return value is false if the host is no onion
+// host.
+func (l *linkRewriter) rewriteHost(host string) (string, bool) {
+	hostname, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		hostname, port = h, p
+	}
+	name, ok := l.onionName(hostname)
+	if !ok {
+		return host, false
+	}
+	hostname = fmt.Sprintf("%s%s", name, l.domain)
+	if port != "" {
+		return net.JoinHostPort(hostname, port), true
+	}
+	return hostname, true
+}
+
+// onionName returns the labels in front of .onion of an onion hostname.
+// Services with an alias are mapped to the alias.
+func (l *linkRewriter) onionName(hostname string) (string, bool) {
+	target, ok := onionTargetForHostname(hostname)
+	if !ok {
+		return "", false
+	}
+	if alias, ok := l.aliases.lookupService(target.ServiceID); ok {
+		target.ServiceID = alias
+	}
+	return target.Name(), true
+}
+
+// onionReplacer returns a replacer for bodies we can not parse. Links to
+// services with an alias are mapped to the alias.
+func (l *linkRewriter) onionReplacer() bodyReplacer {
+	if l.path != nil {
+		return &pathReplacer{links: l}
+	}
+	r := &onionReplacer{}
+	if l.aliases != nil {
+		for id, alias := range l.aliases.byService {
+			for _, suffix := range onionReplacerSuffixes {
+				r.add([]byte(fmt.Sprintf("%s.onion%s", id, suffix)), []byte(fmt.Sprintf("%s%s%s", alias, l.domain, suffix)))
+			}
+		}
+	}
+	for _, suffix := range onionReplacerSuffixes {
+		r.add([]byte(fmt.Sprintf(".onion%s", suffix)), []byte(fmt.Sprintf("%s%s", l.domain, suffix)))
+	}
+	return r
+}
+
+// replaceHeader replaces every .onion in a header value with our domain.
+// Services with an alias are mapped to the alias.
+func (l *linkRewriter) replaceHeader(value string) string {
+	if l.path != nil {
+		return string(l.onionReplacer().replace([]byte(value)))
+	}
+	var oldnew []string
+	if l.aliases != nil {
+		for id, alias := range l.aliases.byService {
+			oldnew = append(oldnew, fmt.Sprintf("%s.onion", id), fmt.Sprintf("%s%s", alias, l.domain))
+		}
+	}
+	oldnew = append(oldnew, ".onion", l.domain)
+	// a single pass so our domain is not replaced again if it contains .onion
+	return strings.NewReplacer(oldnew...).Replace(value)
+}
+
+// rewriteLocation rewrites headers containing a single url like Location.
+// In path mode root relative urls need the prefix of the service.
+func (l *linkRewriter) rewriteLocation(value string) string {
+	if l.path != nil {
+		value = l.rewriteURL(value)
+	}
+	return l.replaceHeader(value)
+}
+
+// rewriteURL rewrites absolute and protocol relative urls pointing to an
+// onion service. Everything except the host is left untouched.
+func (l *linkRewriter) rewriteURL(raw string) string {
+	if l.path != nil {
+		return l.rewritePathURL(raw)
+	}
+	start, end := urlAuthority(raw)
+	if start < 0 {
+		return raw
+	}
+	authority := raw[start:end]
+	userinfo := ""
+	if i := strings.LastIndex(authority, "@"); i >= 0 {
+		userinfo, authority = authority[:i+1], authority[i+1:]
+	}
+	host, ok := l.rewriteHost(authority)
+	if !ok {
+		return raw
+	}
+	return fmt.Sprintf("%s%s%s%s", raw[:start], userinfo, host, raw[end:])
+}
+
+// urlAuthority returns the position of the authority part of an url
+// https://www.rfc-editor.org/rfc/rfc3986#section-3.2
+func urlAuthority(raw string) (int, int) {
+	leading := len(raw) - len(strings.TrimLeft(raw, " \t\r\n\f"))
+	rest := raw[leading:]
+	// optional scheme
+	if i := strings.Index(rest, ":"); i > 0 && isURLScheme(rest[:i]) {
+		leading += i + 1
+		rest = rest[i+1:]
+	}
+	if !strings.HasPrefix(rest, "//") {
+		return -1, -1
+	}
+	start := leading + 2
+	end := len(raw)
+	if i := strings.IndexAny(raw[start:], "/?#\\ \t\r\n\f"); i >= 0 {
+		end = start + i
+	}
+	return start, end
+}
+
+func isURLScheme(s string) bool {
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+// reverse maps all hosts on our domain back to their onion hosts. Only full
+// hostnames are replaced so other domains ending in our domain stay intact.
+func (l *linkRewriter) reverse(data []byte) []byte {
+	if l.path != nil {
+		return l.reversePath(data)
+	}
+	lower := bytes.ToLower(data)
+	suffix := []byte(strings.ToLower(l.domain))
+	var out bytes.Buffer
+	last := 0
+	for offset := 0; ; {
+		i := bytes.Index(lower[offset:], suffix)
+		if i < 0 {
+			break
+		}
+		start := offset + i
+		end := start + len(suffix)
+		offset = end
+		if start == 0 || !isHostnameChar(data[start-1]) || data[start-1] == '.' {
+			continue
+		}
+		if end < len(data) && isHostnameChar(data[end]) {
+			continue
+		}
+		// the label in front of our domain could be an alias
+		labelStart := start
+		for labelStart > last && isHostnameChar(data[labelStart-1]) && data[labelStart-1] != '.' {
+			labelStart--
+		}
+		// in urlencoded data the label starts after an escape like %2F
+		if labelStart > last && data[labelStart-1] == '%' && start-labelStart > 2 && isHexDigit(data[labelStart]) && isHexDigit(data[labelStart+1]) {
+			labelStart += 2
+		}
+		if id, ok := l.aliases.lookupName(string(data[labelStart:start])); ok {
+			out.Write(data[last:labelStart])
+			out.WriteString(fmt.Sprintf("%s.onion", id))
+			last = end
+			continue
+		}
+		out.Write(data[last:start])
+		out.WriteString(".onion")
+		last = end
+	}
+	if last == 0 {
+		return data
+	}
+	out.Write(data[last:])
+	return out.Bytes()
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func isHostnameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.'
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+)
+
+// cssRewriter rewrites onion links in url() tokens and @import rules
+// https://www.w3.org/TR/css-syntax-3/
+type cssRewriter struct {
+	links *linkRewriter
+}
+
+func newCSSRewriter(links *linkRewriter) *cssRewriter {
+	return &cssRewriter{
+		links: links,
+	}
+}
+
+func (c *cssRewriter) rewrite(css []byte) []byte {
+	var out bytes.Buffer
+	last := 0
+	scanCSS(css, func(start, end int) {
+		target := string(css[start:end])
+		rewritten := c.links.rewriteURL(target)
+		if rewritten == target {
+			return
+		}
+		out.Write(css[last:start])
+		out.WriteString(rewritten)
+		last = end
+	})
+	if last == 0 {
+		return css
+	}
+	out.Write(css[last:])
+	return out.Bytes()
+}
+
+// split cuts the stylesheet after the last complete statement so an url is
+// never split between two tokens
+func (c *cssRewriter) split(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	cut := scanCSS(data, func(int, int) {})
+	if cut == 0 {
+		if len(data) >= maxRewriteTokenSize {
+			// no statement boundary in sight, give up on this part
+			return len(data), data, nil
+		}
+		// request more data
+		return 0, nil, nil
+	}
+	return cut, data[:cut], nil
+}
+
+// scanCSS calls visit with the position of every url inside of an url() token
+// or an @import string. The return value is the position after the last
+// complete statement.
+func scanCSS(css []byte, visit func(start, end int)) int {
+	safe := 0
+	afterImport := false
+	for i := 0; i < len(css); {
+		switch {
+		case bytes.HasPrefix(css[i:], []byte("/*")):
+			end := bytes.Index(css[i+2:], []byte("*/"))
+			if end < 0 {
+				return safe
+			}
+			i += end + 4
+		case css[i] == '"' || css[i] == '\'':
+			end, ok := cssStringEnd(css, i)
+			if !ok {
+				return safe
+			}
+			if afterImport {
+				visit(i+1, end-1)
+				afterImport = false
+			}
+			i = end
+		case hasPrefixFold(css[i:], "url(") && (i == 0 || !isCSSNameChar(css[i-1])):
+			start, end, next, ok := cssURLToken(css, i+len("url("))
+			if !ok {
+				return safe
+			}
+			visit(start, end)
+			afterImport = false
+			i = next
+		case hasPrefixFold(css[i:], "@import") && (i+len("@import") == len(css) || !isCSSNameChar(css[i+len("@import")])):
+			afterImport = true
+			i += len("@import")
+		case css[i] == ';' || css[i] == '{' || css[i] == '}':
+			afterImport = false
+			i++
+			safe = i
+		case css[i] == '\\':
+			// escaped character
+			i += 2
+		default:
+			i++
+		}
+	}
+	return safe
+}
+
+// cssStringEnd returns the position after the closing quote of the string
+// starting at start
+func cssStringEnd(css []byte, start int) (int, bool) {
+	quote := css[start]
+	for i := start + 1; i < len(css); i++ {
+		switch css[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1, true
+		}
+	}
+	return len(css), false
+}
+
+// cssURLToken parses the content of an url() token starting after the opening
+// bracket. It returns the position of the url and the position after the
+// closing bracket.
+func cssURLToken(css []byte, i int) (int, int, int, bool) {
+	for i < len(css) && isCSSWhitespace(css[i]) {
+		i++
+	}
+	if i >= len(css) {
+		return 0, 0, 0, false
+	}
+
+	var start, end int
+	if css[i] == '"' || css[i] == '\'' {
+		stringEnd, ok := cssStringEnd(css, i)
+		if !ok {
+			return 0, 0, 0, false
+		}
+		start, end = i+1, stringEnd-1
+		i = stringEnd
+	} else {
+		start = i
+		for i < len(css) && css[i] != ')' && !isCSSWhitespace(css[i]) {
+			if css[i] == '\\' {
+				i++
+			}
+			i++
+		}
+		if i > len(css) {
+			i = len(css)
+		}
+		end = i
+	}
+
+	for i < len(css) && css[i] != ')' {
+		i++
+	}
+	if i >= len(css) {
+		return 0, 0, 0, false
+	}
+	return start, end, i + 1, true
+}
+
+func hasPrefixFold(s []byte, prefix string) bool {
+	return len(s) >= len(prefix) && bytes.EqualFold(s[:len(prefix)], []byte(prefix))
+}
+
+func isCSSNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c >= 0x80
+}
+
+func isCSSWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
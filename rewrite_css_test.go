@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSSRewriter(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"empty", "", ""},
+		{"no urls", "body { color: red; }", "body { color: red; }"},
+		{"unquoted", "a { background: url(http://x.onion) }", "a { background: url(http://x.xxx.zwiebel) }"},
+		{"unquoted path", "a { background: url(http://x.onion/a.png) }", "a { background: url(http://x.xxx.zwiebel/a.png) }"},
+		{"single quoted protocol relative", "a { background: url('//x.onion/a.png') }", "a { background: url('//x.xxx.zwiebel/a.png') }"},
+		{"double quoted", `a { background: url("https://x.onion/a.png") }`, `a { background: url("https://x.xxx.zwiebel/a.png") }`},
+		{"whitespace", "a { background: url(  http://x.onion/a.png  ) }", "a { background: url(  http://x.xxx.zwiebel/a.png  ) }"},
+		{"uppercase", "a { background: URL(HTTP://X.ONION/a.png) }", "a { background: URL(HTTP://X.xxx.zwiebel/a.png) }"},
+		{"port", "a { background: url(http://x.onion:8080/a.png) }", "a { background: url(http://x.xxx.zwiebel:8080/a.png) }"},
+		{"import string", `@import "http://x.onion:8080/s.css";`, `@import "http://x.xxx.zwiebel:8080/s.css";`},
+		{"import single quoted", `@import 'http://x.onion/s.css' screen;`, `@import 'http://x.xxx.zwiebel/s.css' screen;`},
+		{"import url", `@import url("//x.onion/s.css");`, `@import url("//x.xxx.zwiebel/s.css");`},
+		{"font face", `@font-face { src: url(http://x.onion/f.woff2) format("woff2"), url(http://y.onion/f.woff) format("woff"); }`, `@font-face { src: url(http://x.xxx.zwiebel/f.woff2) format("woff2"), url(http://y.xxx.zwiebel/f.woff) format("woff"); }`},
+		{"relative", "a { background: url(/x.onion/a.png) }", "a { background: url(/x.onion/a.png) }"},
+		{"other host", "a { background: url(http://example.com/x.onion) }", "a { background: url(http://example.com/x.onion) }"},
+		{"content string", `a::after { content: "http://x.onion/" }`, `a::after { content: "http://x.onion/" }`},
+		{"comment", "/* url(http://x.onion/) */ a { color: red }", "/* url(http://x.onion/) */ a { color: red }"},
+		{"not a url function", "a { background: myurl(http://x.onion/) }", "a { background: myurl(http://x.onion/) }"},
+		{"data uri", "a { background: url(data:image/png;base64,iVBORw0KGgo=) }", "a { background: url(data:image/png;base64,iVBORw0KGgo=) }"},
+		{"unterminated", "a { background: url(http://x.onion/", "a { background: url(http://x.onion/"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			rewriter := newCSSRewriter(newLinkRewriter(domain))
+			assert.Equal(t, tt.expected, string(rewriter.rewrite([]byte(tt.input))))
+
+			// every chunk size needs to produce the same result when streamed
+			for size := 1; size <= len(tt.input); size++ {
+				src := io.NopCloser(&chunkReader{data: []byte(tt.input), size: size})
+				out, err := io.ReadAll(newRewriteReader(src, rewriter.split, rewriter.rewrite))
+				require.Nil(t, err)
+				assert.Equal(t, tt.expected, string(out), "chunk size %d", size)
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// attributes that contain a single url
+var htmlURLAttributes = map[string]bool{
+	"action":     true,
+	"background": true,
+	"cite":       true,
+	"codebase":   true,
+	"data":       true,
+	"formaction": true,
+	"href":       true,
+	"icon":       true,
+	"longdesc":   true,
+	"manifest":   true,
+	"poster":     true,
+	"src":        true,
+	"usemap":     true,
+	"xlink:href": true,
+}
+
+// attributes that contain a list of urls with descriptors
+// https://developer.mozilla.org/en-US/docs/Web/HTML/Element/img#srcset
+var htmlSrcsetAttributes = map[string]bool{
+	"srcset":      true,
+	"imagesrcset": true,
+}
+
+// htmlRewriter rewrites onion links inside of url bearing attributes and
+// leaves the text content of the document alone
+type htmlRewriter struct {
+	links    *linkRewriter
+	replacer bodyReplacer
+	css      *cssRewriter
+}
+
+func newHTMLRewriter(links *linkRewriter) *htmlRewriter {
+	return &htmlRewriter{
+		links:    links,
+		replacer: links.onionReplacer(),
+		css:      newCSSRewriter(links),
+	}
+}
+
+// rewrite streams the html document from src. Tokens are written as soon as
+// the tokenizer needs to wait for more data.
+func (h *htmlRewriter) rewrite(src io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(pw)
+		z := html.NewTokenizer(&flushingReader{r: src, w: w})
+		// limit the memory used by a single token like the other rewriters
+		z.SetMaxBuf(maxRewriteTokenSize)
+		rawTag := ""
+		for {
+			tt := z.Next()
+			var err error
+			switch tt {
+			case html.ErrorToken:
+				err = z.Err()
+				if err == io.EOF {
+					err = w.Flush()
+				}
+				pw.CloseWithError(err)
+				return
+			case html.StartTagToken, html.SelfClosingTagToken:
+				var out []byte
+				out, rawTag = h.rewriteTag(z, tt)
+				if tt == html.SelfClosingTagToken {
+					rawTag = ""
+				}
+				_, err = w.Write(out)
+			case html.EndTagToken:
+				rawTag = ""
+				_, err = w.Write(z.Raw())
+			case html.TextToken:
+				switch rawTag {
+				case "script":
+					_, err = w.Write(h.replacer.replace(z.Raw()))
+				case "style":
+					_, err = w.Write(h.css.rewrite(z.Raw()))
+				case "iframe", "noembed", "noframes", "noscript", "plaintext", "xmp":
+					// the tokenizer returns the content of these elements as
+					// text, but browsers may render it as html
+					_, err = w.Write(h.replacer.replace(z.Raw()))
+				default:
+					_, err = w.Write(z.Raw())
+				}
+			default:
+				_, err = w.Write(z.Raw())
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return &bodyReadCloser{Reader: pr, closers: []io.Closer{pr, src}}
+}
+
+// rewriteTag returns the raw tag if nothing was modified so the document stays
+// byte for byte the same. The second return value is the tag name.
+func (h *htmlRewriter) rewriteTag(z *html.Tokenizer, tt html.TokenType) ([]byte, string) {
+	// TagName and TagAttr lowercase the names in place so keep a copy
+	raw := append([]byte(nil), z.Raw()...)
+	name, hasAttr := z.TagName()
+	token := html.Token{
+		Type: tt,
+		Data: string(name),
+	}
+	modified := false
+	for hasAttr {
+		var key, val []byte
+		key, val, hasAttr = z.TagAttr()
+		attr := html.Attribute{
+			Key: string(key),
+			Val: string(val),
+		}
+		token.Attr = append(token.Attr, attr)
+	}
+
+	isRefresh := false
+	if token.Data == "meta" {
+		for _, attr := range token.Attr {
+			if attr.Key == "http-equiv" && strings.EqualFold(strings.TrimSpace(attr.Val), "refresh") {
+				isRefresh = true
+			}
+		}
+	}
+
+	for i, attr := range token.Attr {
+		newVal := attr.Val
+		switch {
+		case htmlURLAttributes[attr.Key]:
+			newVal = h.links.rewriteURL(attr.Val)
+		case htmlSrcsetAttributes[attr.Key]:
+			newVal = h.rewriteSrcset(attr.Val)
+		case attr.Key == "ping":
+			newVal = h.rewriteURLList(attr.Val)
+		case attr.Key == "style":
+			newVal = string(h.css.rewrite([]byte(attr.Val)))
+		case attr.Key == "content" && isRefresh:
+			newVal = h.rewriteRefresh(attr.Val)
+		}
+		if newVal != attr.Val {
+			token.Attr[i].Val = newVal
+			modified = true
+		}
+	}
+
+	if !modified {
+		return raw, token.Data
+	}
+	return []byte(token.String()), token.Data
+}
+
+// rewriteSrcset rewrites a list like "a.png 1x, b.png 2x"
+func (h *htmlRewriter) rewriteSrcset(val string) string {
+	candidates := strings.Split(val, ",")
+	for i, candidate := range candidates {
+		trimmed := strings.TrimLeft(candidate, " \t\r\n\f")
+		leading := candidate[:len(candidate)-len(trimmed)]
+		end := strings.IndexAny(trimmed, " \t\r\n\f")
+		if end < 0 {
+			end = len(trimmed)
+		}
+		candidates[i] = leading + h.links.rewriteURL(trimmed[:end]) + trimmed[end:]
+	}
+	return strings.Join(candidates, ",")
+}
+
+// rewriteURLList rewrites a space separated list of urls
+func (h *htmlRewriter) rewriteURLList(val string) string {
+	parts := strings.Split(val, " ")
+	for i, part := range parts {
+		parts[i] = h.links.rewriteURL(part)
+	}
+	return strings.Join(parts, " ")
+}
+
+// rewriteRefresh rewrites the url in a meta refresh like "5; url=http://x.onion/"
+// https://developer.mozilla.org/en-US/docs/Web/HTML/Element/meta#http-equiv
+func (h *htmlRewriter) rewriteRefresh(val string) string {
+	i := strings.Index(strings.ToLower(val), "url=")
+	if i < 0 {
+		return val
+	}
+	prefix, target := val[:i+len("url=")], val[i+len("url="):]
+	quote := ""
+	if strings.HasPrefix(target, `"`) || strings.HasPrefix(target, "'") {
+		quote, target = target[:1], target[1:]
+	}
+	return prefix + quote + h.links.rewriteURL(target)
+}
+
+// flushingReader flushes all pending output before blocking on a read of the
+// source so every complete token is sent to the client immediately
+type flushingReader struct {
+	r io.Reader
+	w *bufio.Writer
+}
+
+func (f *flushingReader) Read(p []byte) (int, error) {
+	if err := f.w.Flush(); err != nil {
+		return 0, err
+	}
+	return f.r.Read(p)
+}
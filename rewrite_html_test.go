@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/html"
+)
+
+func TestHTMLRewriter(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"prose", "<p>visit asdf.onion or http://asdf.onion/ today</p>", "<p>visit asdf.onion or http://asdf.onion/ today</p>"},
+		{"double quoted", `<a href="http://asdf.onion/x">x</a>`, `<a href="http://asdf.xxx.zwiebel/x">x</a>`},
+		{"single quoted", `<a href='http://asdf.onion/x'>x</a>`, `<a href="http://asdf.xxx.zwiebel/x">x</a>`},
+		{"unquoted", `<a href=http://asdf.onion/x>x</a>`, `<a href="http://asdf.xxx.zwiebel/x">x</a>`},
+		{"query", `<a href="http://asdf.onion?a=b">x</a>`, `<a href="http://asdf.xxx.zwiebel?a=b">x</a>`},
+		{"bare host", `<a href="http://asdf.onion">x</a>`, `<a href="http://asdf.xxx.zwiebel">x</a>`},
+		{"port", `<img src="https://asdf.onion:8080/a.png">`, `<img src="https://asdf.xxx.zwiebel:8080/a.png">`},
+		{"protocol relative", `<script src="//asdf.onion/a.js"></script>`, `<script src="//asdf.xxx.zwiebel/a.js"></script>`},
+		{"uppercase", `<A HREF="HTTP://ASDF.ONION/">x</A>`, `<a href="HTTP://ASDF.xxx.zwiebel/">x</A>`},
+		{"relative", `<a href="/asdf.onion/">x</a>`, `<a href="/asdf.onion/">x</a>`},
+		{"other host", `<a href="http://example.com/asdf.onion/">x</a>`, `<a href="http://example.com/asdf.onion/">x</a>`},
+		{"base", `<base href="http://asdf.onion/">`, `<base href="http://asdf.xxx.zwiebel/">`},
+		{"form", `<form action="http://asdf.onion/login" method="post">`, `<form action="http://asdf.xxx.zwiebel/login" method="post">`},
+		{"srcset", `<img srcset="http://a.onion/1.png 1x, http://b.onion/2.png 2x, c.png 3x">`, `<img srcset="http://a.xxx.zwiebel/1.png 1x, http://b.xxx.zwiebel/2.png 2x, c.png 3x">`},
+		{"refresh", `<meta http-equiv="refresh" content="5; url=http://asdf.onion/new">`, `<meta http-equiv="refresh" content="5; url=http://asdf.xxx.zwiebel/new">`},
+		{"refresh quoted", `<meta http-equiv="Refresh" content="0;URL='http://asdf.onion/'">`, `<meta http-equiv="Refresh" content="0;URL=&#39;http://asdf.xxx.zwiebel/&#39;">`},
+		{"meta content", `<meta name="description" content="http://asdf.onion/">`, `<meta name="description" content="http://asdf.onion/">`},
+		{"style attribute", `<div style="background: url('http://asdf.onion/bg.png')">`, `<div style="background: url(&#39;http://asdf.xxx.zwiebel/bg.png&#39;)">`},
+		{"style element", `<style>body { background: url(http://asdf.onion/bg.png) }</style>`, `<style>body { background: url(http://asdf.xxx.zwiebel/bg.png) }</style>`},
+		{"script element", `<script>var u = "http://asdf.onion/api";</script>`, `<script>var u = "http://asdf.xxx.zwiebel/api";</script>`},
+		{"comment", `<!-- http://asdf.onion/ -->`, `<!-- http://asdf.onion/ -->`},
+		{"untouched tag", `<DIV Class="x"  id=y>`, `<DIV Class="x"  id=y>`},
+		{"self closing", `<img src="http://asdf.onion/a.png"/><p>asdf.onion</p>`, `<img src="http://asdf.xxx.zwiebel/a.png"/><p>asdf.onion</p>`},
+		{"userinfo", `<a href="http://user@asdf.onion/">x</a>`, `<a href="http://user@asdf.xxx.zwiebel/">x</a>`},
+		{"noscript", `<noscript><a href="http://asdf.onion/x">asdf.onion</a></noscript>`, `<noscript><a href="http://asdf.xxx.zwiebel/x">asdf.xxx.zwiebel</a></noscript>`},
+		{"iframe content", `<iframe src="http://asdf.onion/"><a href="http://asdf.onion/x">x</a></iframe>`, `<iframe src="http://asdf.xxx.zwiebel/"><a href="http://asdf.xxx.zwiebel/x">x</a></iframe>`},
+		{"noembed", `<noembed><img src="http://asdf.onion/a.png"></noembed>`, `<noembed><img src="http://asdf.xxx.zwiebel/a.png"></noembed>`},
+		{"noframes", `<noframes><a href="http://asdf.onion/">x</a></noframes>`, `<noframes><a href="http://asdf.xxx.zwiebel/">x</a></noframes>`},
+		{"xmp", `<xmp>http://asdf.onion/</xmp>`, `<xmp>http://asdf.xxx.zwiebel/</xmp>`},
+		{"plaintext", `<plaintext>http://asdf.onion/`, `<plaintext>http://asdf.xxx.zwiebel/`},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		for _, size := range []int{1, 3, 4096} {
+			size := size
+			t.Run(fmt.Sprintf("%s/%d", tt.name, size), func(t *testing.T) {
+				t.Parallel()
+
+				src := io.NopCloser(&chunkReader{data: []byte(tt.input), size: size})
+				out, err := io.ReadAll(newHTMLRewriter(newLinkRewriter(domain)).rewrite(src))
+				require.Nil(t, err)
+				assert.Equal(t, tt.expected, string(out))
+			})
+		}
+	}
+}
+
+func TestHTMLRewriterMaxBuf(t *testing.T) {
+	t.Parallel()
+
+	// an unterminated script is never split into tokens
+	input := "<script>" + strings.Repeat("a", maxRewriteTokenSize+1)
+	src := io.NopCloser(strings.NewReader(input))
+	_, err := io.ReadAll(newHTMLRewriter(newLinkRewriter("xxx.zwiebel")).rewrite(src))
+	assert.ErrorIs(t, err, html.ErrBufferExceeded)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkReader returns at most size bytes on every read
+type chunkReader struct {
+	data []byte
+	size int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := c.size
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(c.data) {
+		n = len(c.data)
+	}
+	copy(p, c.data[:n])
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func TestOnionRewriteReader(t *testing.T) {
+	t.Parallel()
+
+	const domain = ".xxx.zwiebel"
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"empty", "", ""},
+		{"no match", "nothing to see here", "nothing to see here"},
+		{"slash", "http://asdf.onion/index.html", "http://asdf.xxx.zwiebel/index.html"},
+		{"quote", `<a href="http://asdf.onion">`, `<a href="http://asdf.xxx.zwiebel">`},
+		{"tag", "<p>asdf.onion</p>", "<p>asdf.xxx.zwiebel</p>"},
+		{"prose", "asdf.onion is a domain", "asdf.onion is a domain"},
+		{"end of input", "asdf.onion", "asdf.onion"},
+		{"multiple", `a.onion/ b.onion" c.onion< .onion/.onion/`, `a.xxx.zwiebel/ b.xxx.zwiebel" c.xxx.zwiebel< .xxx.zwiebel/.xxx.zwiebel/`},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		for size := 1; size <= len(tt.input)+1; size++ {
+			size := size
+			t.Run(fmt.Sprintf("%s/%d", tt.name, size), func(t *testing.T) {
+				t.Parallel()
+
+				replacer := newOnionReplacer(domain)
+				src := io.NopCloser(&chunkReader{data: []byte(tt.input), size: size})
+				out, err := io.ReadAll(newRewriteReader(src, replacer.split, replacer.replace))
+				require.Nil(t, err)
+				assert.Equal(t, tt.expected, string(out))
+			})
+		}
+	}
+}
+
+func TestOnionRewriteReaderStreams(t *testing.T) {
+	t.Parallel()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	replacer := newOnionReplacer(".xxx.zwiebel")
+	reader := newRewriteReader(pr, replacer.split, replacer.replace)
+
+	go func() {
+		_, _ = pw.Write([]byte("first chunk with http://asdf.onion/ in it and some padding"))
+	}()
+
+	result := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		n, _ := reader.Read(buf)
+		result <- string(buf[:n])
+	}()
+
+	select {
+	case got := <-result:
+		assert.Contains(t, got, "http://asdf.xxx.zwiebel/")
+	case <-time.After(5 * time.Second):
+		t.Fatal("rewriter did not emit data before the body was complete")
+	}
+}
+
+func TestModifyResponseStreamsGzip(t *testing.T) {
+	t.Parallel()
+
+	const domain = "xxx.zwiebel"
+	body := bytes.Repeat([]byte(`<a href="http://asdf.onion/x">asdf.onion</a>`), 1000)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write(body)
+	require.Nil(t, err)
+	require.Nil(t, gz.Close())
+
+	resp := http.Response{
+		StatusCode: 200,
+		Request: &http.Request{
+			URL: &url.URL{},
+		},
+		Header:        make(http.Header),
+		ContentLength: int64(compressed.Len()),
+		Body:          io.NopCloser(&chunkReader{data: compressed.Bytes(), size: 7}),
+	}
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp.Header.Set("Content-Encoding", "gzip")
+	resp.Header.Set("Content-Length", fmt.Sprint(compressed.Len()))
+
+	app := application{
+		domains: []string{domain},
+		logger:  &DiscardLogger{},
+	}
+	require.Nil(t, app.modifyResponse(&resp))
+	defer resp.Body.Close()
+
+	assert.Empty(t, resp.Header.Get("Content-Length"))
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	gzipReader, err := gzip.NewReader(resp.Body)
+	require.Nil(t, err)
+	modifiedBody, err := io.ReadAll(gzipReader)
+	require.Nil(t, err)
+
+	expected := bytes.ReplaceAll(body, []byte(".onion/"), []byte(".xxx.zwiebel/"))
+	expected = bytes.ReplaceAll(expected, []byte(".onion<"), []byte(".xxx.zwiebel<"))
+	assert.Equal(t, string(expected), string(modifiedBody))
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// fakeSOCKSRequest is a CONNECT request received by the fakeSOCKSServer
+type fakeSOCKSRequest struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+// fakeSOCKSServer is a minimal SOCKS5 server standing in for TOR. Every
+// CONNECT is forwarded to target regardless of the requested host.
+// https://www.rfc-editor.org/rfc/rfc1928
+type fakeSOCKSServer struct {
+	listener net.Listener
+	target   string
+
+	mu       sync.Mutex
+	requests []fakeSOCKSRequest
+	reply    byte
+	// replies are sent for the next CONNECT requests before reply is used
+	replies []byte
+}
+
+func newFakeSOCKSServer(t *testing.T, target string) *fakeSOCKSServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSOCKSServer{
+		listener: listener,
+		target:   target,
+	}
+	t.Cleanup(func() {
+		s.listener.Close()
+	})
+	go s.serve()
+	return s
+}
+
+func (s *fakeSOCKSServer) URL() string {
+	return fmt.Sprintf("socks5://%s", s.listener.Addr().String())
+}
+
+// setReply sets the reply code sent for CONNECT requests, 0 forwards the
+// connection to the target
+// https://www.rfc-editor.org/rfc/rfc1928#section-6
+func (s *fakeSOCKSServer) setReply(reply byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reply = reply
+}
+
+// setReplies sets the reply codes sent for the next CONNECT requests, after
+// that the code of setReply is used
+func (s *fakeSOCKSServer) setReplies(replies ...byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replies = replies
+}
+
+func (s *fakeSOCKSServer) Requests() []fakeSOCKSRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeSOCKSRequest(nil), s.requests...)
+}
+
+func (s *fakeSOCKSServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSOCKSServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	// greeting: version, number of methods, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	var request fakeSOCKSRequest
+	if containsByte(methods, 2) {
+		// username and password authentication
+		// https://www.rfc-editor.org/rfc/rfc1929
+		if _, err := conn.Write([]byte{5, 2}); err != nil {
+			return
+		}
+		username, password, err := readSOCKSCredentials(conn)
+		if err != nil {
+			return
+		}
+		request.Username = username
+		request.Password = password
+		if _, err := conn.Write([]byte{1, 0}); err != nil {
+			return
+		}
+	} else if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	// request: version, command, reserved, address type
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil || req[1] != 1 {
+		return
+	}
+	switch req[3] {
+	case 1:
+		addr := make([]byte, 4)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return
+		}
+		request.Host = net.IP(addr).String()
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return
+		}
+		addr := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return
+		}
+		request.Host = string(addr)
+	case 4:
+		addr := make([]byte, 16)
+		if _, err := io.ReadFull(conn, addr); err != nil {
+			return
+		}
+		request.Host = net.IP(addr).String()
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	request.Port = int(binary.BigEndian.Uint16(port))
+
+	s.mu.Lock()
+	s.requests = append(s.requests, request)
+	reply := s.reply
+	if len(s.replies) > 0 {
+		reply, s.replies = s.replies[0], s.replies[1:]
+	}
+	s.mu.Unlock()
+
+	var upstream net.Conn
+	if reply == 0 {
+		var err error
+		upstream, err = net.Dial("tcp", s.target)
+		if err != nil {
+			reply = 5 // connection refused
+		} else {
+			defer upstream.Close()
+		}
+	}
+
+	if _, err := conn.Write([]byte{5, reply, 0, 1, 127, 0, 0, 1, 0, 0}); err != nil || reply != 0 {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func readSOCKSCredentials(r io.Reader) (string, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", "", err
+	}
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(r, username); err != nil {
+		return "", "", err
+	}
+	l := make([]byte, 1)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return "", "", err
+	}
+	password := make([]byte, l[0])
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", "", err
+	}
+	return string(username), string(password), nil
+}
+
+func containsByte(haystack []byte, needle byte) bool {
+	for _, b := range haystack {
+		if b == needle {
+			return true
+		}
+	}
+	return false
+}
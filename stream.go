@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// content types that are streamed to the client for an unknown amount of time
+var streamingContentTypes = []string{
+	"text/event-stream",
+	"multipart/x-mixed-replace",
+}
+
+func isStreamingResponse(resp *http.Response) bool {
+	contentType := strings.ToLower(strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0]))
+	return sliceContains(streamingContentTypes, contentType)
+}
+
+// longPollPath marks requests as long-polls that may wait for the response
+// longer than the request timeout. An empty host matches all onion services.
+type longPollPath struct {
+	host   string
+	prefix string
+}
+
+// parseLongPollPaths parses a comma separated list of path prefixes like
+// /poll or abc.onion/poll
+func parseLongPollPaths(s string) ([]longPollPath, error) {
+	var paths []longPollPath
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid long-poll path %q: missing path", entry)
+		}
+		host := strings.ToLower(entry[:i])
+		if host != "" && !strings.HasSuffix(host, ".onion") {
+			return nil, fmt.Errorf("invalid long-poll path %q: %q is not an onion host", entry, host)
+		}
+		paths = append(paths, longPollPath{host: host, prefix: entry[i:]})
+	}
+	return paths, nil
+}
+
+// isLongPoll reports if the request goes to one of the long-poll paths
+func (app *application) isLongPoll(r *http.Request, target onionTarget) bool {
+	if len(app.longPollPaths) == 0 {
+		return false
+	}
+	u := *r.URL
+	if _, ok := pathRouteFromRequest(r); ok {
+		stripPathPrefix(&u)
+	}
+	for _, p := range app.longPollPaths {
+		if (p.host == "" || p.host == target.Hostname()) && strings.HasPrefix(u.Path, p.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestDeadline cancels a request once the timeout is reached. By default
+// this is a hard deadline for the whole request. Streaming responses switch it
+// to an idle timeout that is reset on every read from the hidden service.
+type requestDeadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	timeout time.Duration
+	idle    bool
+}
+
+func newRequestDeadline(timeout time.Duration, cancel func()) *requestDeadline {
+	return &requestDeadline{
+		timer:   time.AfterFunc(timeout, cancel),
+		timeout: timeout,
+	}
+}
+
+// isIdle reports if the deadline is an idle timeout
+func (d *requestDeadline) isIdle() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.idle
+}
+
+// switchToIdle turns the deadline into an idle timeout starting now
+func (d *requestDeadline) switchToIdle() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.idle = true
+	d.timer.Reset(d.timeout)
+}
+
+// touch extends an idle timeout after some data arrived
+func (d *requestDeadline) touch() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.idle {
+		d.timer.Reset(d.timeout)
+	}
+}
+
+func (d *requestDeadline) stop() {
+	d.timer.Stop()
+}
+
+// idleTimeoutReader extends the deadline on every read returning data
+type idleTimeoutReader struct {
+	io.ReadCloser
+	deadline *requestDeadline
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.deadline.touch()
+	}
+	return n, err
+}
+
+// splitLines returns every complete line including the line ending so server
+// sent events can be rewritten and flushed line by line
+// https://html.spec.whatwg.org/multipage/server-sent-events.html#event-stream-interpretation
+func splitLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		end := i + 1
+		if data[i] == '\r' {
+			if end == len(data) && !atEOF {
+				// could be a \r\n line ending
+				return 0, nil, nil
+			}
+			if end < len(data) && data[end] == '\n' {
+				end++
+			}
+		}
+		return end, data[:end], nil
+	}
+	if atEOF || len(data) >= maxRewriteTokenSize {
+		return len(data), data, nil
+	}
+	// request more data
+	return 0, nil, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitLines(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"lf", "data: http://a.onion/\n\ndata: b.onion\"\n\n", "data: http://a.xxx.zwiebel/\n\ndata: b.xxx.zwiebel\"\n\n"},
+		{"crlf", "event: x\r\ndata: http://a.onion/\r\n\r\n", "event: x\r\ndata: http://a.xxx.zwiebel/\r\n\r\n"},
+		{"cr", "data: http://a.onion/\r\r", "data: http://a.xxx.zwiebel/\r\r"},
+		{"no trailing newline", "data: http://a.onion/", "data: http://a.xxx.zwiebel/"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			replacer := newOnionReplacer(".xxx.zwiebel")
+			for size := 1; size <= len(tt.input); size++ {
+				src := io.NopCloser(&chunkReader{data: []byte(tt.input), size: size})
+				out, err := io.ReadAll(newRewriteReader(src, splitLines, replacer.replace))
+				require.Nil(t, err)
+				assert.Equal(t, tt.expected, string(out), "chunk size %d", size)
+			}
+		})
+	}
+}
+
+// sseHandler sends count events with the given delay in between and then
+// keeps the connection open for stall
+func sseHandler(count int, delay, stall time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < count; i++ {
+			fmt.Fprintf(w, "id: %d\ndata: http://asdf.onion/%d\n\n", i, i)
+			w.(http.Flusher).Flush()
+			time.Sleep(delay)
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(stall):
+		}
+	}
+}
+
+func TestServerSentEvents(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	tests := []struct {
+		name           string
+		count          int
+		delay          time.Duration
+		stall          time.Duration
+		expectedEvents int
+		maxDuration    time.Duration
+	}{
+		// the stream takes longer than the timeout but is never idle
+		{"active stream", 6, 60 * time.Millisecond, 0, 6, 5 * time.Second},
+		// the stream is aborted after the idle timeout
+		{"stalled stream", 1, 0, 10 * time.Second, 1, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			upstream := httptest.NewServer(sseHandler(tt.count, tt.delay, tt.stall))
+			defer upstream.Close()
+
+			socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+			app := newTestApplication(t, domain, socks.URL())
+			app.timeout = 200 * time.Millisecond
+			proxy := httptest.NewServer(app.routes())
+			defer proxy.Close()
+
+			req, err := http.NewRequest(http.MethodGet, proxy.URL, nil)
+			require.Nil(t, err)
+			req.Host = fmt.Sprintf("%s.%s", testOnionID, domain)
+
+			start := time.Now()
+			resp, err := http.DefaultClient.Do(req)
+			require.Nil(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+			var events []string
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+					events = append(events, line)
+				}
+			}
+			assert.Less(t, time.Since(start), tt.maxDuration)
+			require.Len(t, events, tt.expectedEvents)
+			for i, event := range events {
+				assert.Equal(t, fmt.Sprintf("data: http://asdf.%s/%d", domain, i), event)
+			}
+		})
+	}
+}
+
+func TestParseLongPollPaths(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []longPollPath
+		err      bool
+	}{
+		{"empty", "", nil, false},
+		{"all onions", "/poll, /api/updates", []longPollPath{{prefix: "/poll"}, {prefix: "/api/updates"}}, false},
+		{"onion host", fmt.Sprintf("API.%s.onion/poll", testOnionID), []longPollPath{{host: fmt.Sprintf("api.%s.onion", testOnionID), prefix: "/poll"}}, false},
+		{"missing path", "poll", nil, true},
+		{"no onion host", "example.com/poll", nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			paths, err := parseLongPollPaths(tt.input)
+			if tt.err {
+				assert.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			assert.Equal(t, tt.expected, paths)
+		})
+	}
+}
+
+func TestLongPoll(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait := 400 * time.Millisecond
+		if strings.HasSuffix(r.URL.Path, "/stall") {
+			wait = 10 * time.Second
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(wait):
+		}
+		fmt.Fprint(w, "update")
+	}))
+	defer upstream.Close()
+
+	socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+	app := newTestApplication(t, domain, socks.URL())
+	app.timeout = 200 * time.Millisecond
+	app.longPollTimeout = time.Second
+	paths, err := parseLongPollPaths(fmt.Sprintf("/poll,%s.onion/other", testOnionIDOther))
+	require.Nil(t, err)
+	app.longPollPaths = paths
+	handler := app.routes()
+
+	request := func(onion, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Host = fmt.Sprintf("%s.%s", onion, domain)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// long-polls may wait longer than the timeout
+	w := request(testOnionID, "/poll")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "update", w.Body.String())
+	assert.Equal(t, http.StatusOK, request(testOnionIDOther, "/other").Code)
+
+	// other requests keep the timeout
+	assert.Equal(t, http.StatusGatewayTimeout, request(testOnionID, "/other").Code)
+
+	// long-polls are still aborted after the long-poll timeout
+	start := time.Now()
+	assert.Equal(t, http.StatusGatewayTimeout, request(testOnionID, "/poll/stall").Code)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// tlsMode decides how the certificates of https onion services are checked.
+// Onion addresses already authenticate the service so most services use self
+// signed certificates, which is why skip is the default.
+type tlsMode string
+
+const (
+	tlsSkip   tlsMode = "skip"
+	tlsVerify tlsMode = "verify"
+	tlsPin    tlsMode = "pin"
+)
+
+// tlsPolicy is the policy of a single onion service
+type tlsPolicy struct {
+	Mode tlsMode
+	// Pins are the SHA256 hashes of the pinned public keys
+	Pins [][]byte
+}
+
+// tlsPolicies holds the policies by hostname and service id
+type tlsPolicies struct {
+	exact    map[string]tlsPolicy
+	wildcard map[string]tlsPolicy
+}
+
+// tlsPinError is returned if no certificate matches a pinned key
+type tlsPinError struct {
+	Host string
+	// Got contains the hashes of the keys sent by the service
+	Got []string
+}
+
+func (e *tlsPinError) Error() string {
+	return fmt.Sprintf("the certificate of %s does not match the pinned public keys, received %s", e.Host, strings.Join(e.Got, ", "))
+}
+
+func parseTLSMode(s string) (tlsMode, error) {
+	switch mode := tlsMode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case tlsSkip, tlsVerify, tlsPin:
+		return mode, nil
+	default:
+		return tlsSkip, fmt.Errorf("invalid tls mode %q, valid modes are skip, verify and pin", s)
+	}
+}
+
+// loadTLSPolicies reads a policy file. Every line contains an onion host
+// like in the allowlist, the mode and for pin a comma separated list of
+// SHA256 hashes of the public keys. Empty lines and lines starting with # are
+// ignored:
+//
+//	*.duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion verify
+//	api.duckduckgogg42xjoc72x3sjasowoarfbgcmvfimaftt6twagswzczad.onion pin sha256/<base64 hash>,sha256/<base64 hash>
+func loadTLSPolicies(path string) (*tlsPolicies, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open tls policy file: %w", err)
+	}
+	defer f.Close()
+	policies, err := parseTLSPolicies(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return policies, nil
+}
+
+func parseTLSPolicies(r io.Reader) (*tlsPolicies, error) {
+	p := &tlsPolicies{
+		exact:    make(map[string]tlsPolicy),
+		wildcard: make(map[string]tlsPolicy),
+	}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected an onion address, a mode and the pins for mode pin", lineNumber)
+		}
+		host := strings.ToLower(fields[0])
+		wildcard := strings.HasPrefix(host, "*.")
+		host = strings.TrimPrefix(host, "*.")
+		if !strings.HasSuffix(host, ".onion") {
+			host = fmt.Sprintf("%s.onion", host)
+		}
+		target, err := parseOnionTarget(host, "", ".onion")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if wildcard && len(target.Subdomains) > 0 {
+			return nil, fmt.Errorf("line %d: wildcards are only supported in front of the service id", lineNumber)
+		}
+		mode, err := parseTLSMode(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		policy := tlsPolicy{Mode: mode}
+		switch {
+		case mode == tlsPin && len(fields) != 3:
+			return nil, fmt.Errorf("line %d: mode pin needs at least one pin", lineNumber)
+		case mode != tlsPin && len(fields) != 2:
+			return nil, fmt.Errorf("line %d: pins are only supported for mode pin", lineNumber)
+		case mode == tlsPin:
+			for _, pin := range strings.Split(fields[2], ",") {
+				hash, err := parseTLSPin(pin)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+				}
+				policy.Pins = append(policy.Pins, hash)
+			}
+		}
+		if wildcard {
+			p.wildcard[target.ServiceID] = policy
+			continue
+		}
+		p.exact[target.Hostname()] = policy
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read tls policy file: %w", err)
+	}
+	return p, nil
+}
+
+// parseTLSPin parses a base64 encoded SHA256 hash with an optional sha256/
+// prefix like the pins of curl
+func parseTLSPin(pin string) ([]byte, error) {
+	pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+	hash, err := base64.StdEncoding.DecodeString(pin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pin %q: %w", pin, err)
+	}
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q: expected a SHA256 hash", pin)
+	}
+	return hash, nil
+}
+
+// spkiHash returns the pin of the public key of cert
+func spkiHash(cert *x509.Certificate) []byte {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hash[:]
+}
+
+// lookup returns the policy of an onion host, exact entries win over
+// wildcards
+func (p *tlsPolicies) lookup(hostname string) (tlsPolicy, bool) {
+	if p == nil {
+		return tlsPolicy{}, false
+	}
+	hostname = strings.ToLower(hostname)
+	if policy, ok := p.exact[hostname]; ok {
+		return policy, true
+	}
+	target, err := parseOnionTarget(hostname, "", ".onion")
+	if err != nil {
+		return tlsPolicy{}, false
+	}
+	policy, ok := p.wildcard[target.ServiceID]
+	return policy, ok
+}
+
+// loadTLSPolicies (re)loads the tls policies from disk. The current policies
+// stay active if the file can not be loaded.
+func (app *application) loadTLSPolicies() error {
+	if app.tlsPolicyPath == "" {
+		return nil
+	}
+	policies, err := loadTLSPolicies(app.tlsPolicyPath)
+	if err != nil {
+		return err
+	}
+	app.tlsPolicies.Store(policies)
+	return nil
+}
+
+// tlsClientConfig returns the tls config of the transport. The built in
+// verification is disabled as it can not be configured per host, the
+// certificates are checked in verifyTLSConnection instead.
+func (app *application) tlsClientConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   app.verifyTLSConnection,
+	}
+}
+
+// verifyTLSConnection checks the certificates of an onion service according
+// to its policy
+func (app *application) verifyTLSConnection(cs tls.ConnectionState) error {
+	policy, ok := app.tlsPolicies.Load().lookup(cs.ServerName)
+	if !ok {
+		policy = tlsPolicy{Mode: app.tlsDefault}
+	}
+	if len(cs.PeerCertificates) == 0 {
+		if policy.Mode == tlsSkip {
+			return nil
+		}
+		return fmt.Errorf("%s did not send a certificate", cs.ServerName)
+	}
+
+	switch policy.Mode {
+	case tlsVerify:
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         app.tlsRoots,
+			DNSName:       cs.ServerName,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return fmt.Errorf("could not verify the certificate of %s: %w", cs.ServerName, err)
+		}
+	case tlsPin:
+		// any key in the chain can be pinned, like a key of the issuer. The
+		// handshake only proves the possession of the key of the leaf, so
+		// the other certificates need to be part of its signature chain.
+		var got []string
+		for i, cert := range cs.PeerCertificates {
+			if i > 0 && cs.PeerCertificates[i-1].CheckSignatureFrom(cert) != nil {
+				break
+			}
+			hash := spkiHash(cert)
+			for _, pin := range policy.Pins {
+				if bytes.Equal(hash, pin) {
+					return nil
+				}
+			}
+			got = append(got, fmt.Sprintf("sha256/%s", base64.StdEncoding.EncodeToString(hash)))
+		}
+		return &tlsPinError{Host: cs.ServerName, Got: got}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCertificate returns a self signed certificate for the hosts
+func newTestCertificate(t *testing.T, hosts ...string) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		DNSNames:              hosts,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+// newTestLeafCertificate returns a certificate for the hosts signed by the
+// issuer, the issuer is sent along with the certificate
+func newTestLeafCertificate(t *testing.T, issuer tls.Certificate, hosts ...string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer.Leaf, &key.PublicKey, issuer.PrivateKey)
+	require.Nil(t, err)
+	return tls.Certificate{Certificate: [][]byte{der, issuer.Certificate[0]}, PrivateKey: key}
+}
+
+func testPin(cert *x509.Certificate) string {
+	return fmt.Sprintf("sha256/%s", base64.StdEncoding.EncodeToString(spkiHash(cert)))
+}
+
+func TestParseTLSPolicies(t *testing.T) {
+	t.Parallel()
+
+	pin := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		name  string
+		input string
+		host  string
+		mode  tlsMode
+		found bool
+		err   string
+	}{
+		{"exact", fmt.Sprintf("%s.onion verify\n", testOnionID), testOnionID + ".onion", tlsVerify, true, ""},
+		{"exact without suffix", fmt.Sprintf("%s SKIP\n", testOnionID), testOnionID + ".onion", tlsSkip, true, ""},
+		{"exact subdomain", fmt.Sprintf("%s.onion verify\n", testOnionID), "api." + testOnionID + ".onion", "", false, ""},
+		{"wildcard", fmt.Sprintf("*.%s.onion pin sha256/%s,%s\n", testOnionID, pin, pin), "api." + testOnionID + ".onion", tlsPin, true, ""},
+		{"exact before wildcard", fmt.Sprintf("*.%s.onion verify\napi.%s.onion skip\n", testOnionID, testOnionID), "api." + testOnionID + ".onion", tlsSkip, true, ""},
+		{"other service", fmt.Sprintf("*.%s.onion verify\n", testOnionID), testOnionIDOther + ".onion", "", false, ""},
+		{"invalid mode", fmt.Sprintf("%s.onion check\n", testOnionID), "", "", false, "line 1: invalid tls mode"},
+		{"pin without pins", fmt.Sprintf("%s.onion pin\n", testOnionID), "", "", false, "line 1: mode pin needs at least one pin"},
+		{"pins without pin", fmt.Sprintf("%s.onion verify sha256/%s\n", testOnionID, pin), "", "", false, "line 1: pins are only supported for mode pin"},
+		{"invalid pin", fmt.Sprintf("%s.onion pin sha256/AAAA\n", testOnionID), "", "", false, "line 1: invalid pin"},
+		{"invalid host", "invalid.onion verify\n", "", "", false, "line 1"},
+		{"invalid wildcard", fmt.Sprintf("*.api.%s.onion verify\n", testOnionID), "", "", false, "line 1: wildcards are only supported in front of the service id"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			policies, err := parseTLSPolicies(strings.NewReader(tt.input))
+			if tt.err != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.Nil(t, err)
+			policy, ok := policies.lookup(tt.host)
+			assert.Equal(t, tt.found, ok)
+			assert.Equal(t, tt.mode, policy.Mode)
+		})
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	host := fmt.Sprintf("%s.onion", testOnionID)
+	cert, leaf := newTestCertificate(t, host)
+	_, other := newTestCertificate(t, "other.example")
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	tests := []struct {
+		name           string
+		policy         string
+		defaultMode    tlsMode
+		roots          *x509.CertPool
+		expectedStatus int
+		expectedError  string
+	}{
+		{"default skip", "", tlsSkip, nil, http.StatusOK, ""},
+		{"skip", fmt.Sprintf("%s skip\n", host), tlsVerify, nil, http.StatusOK, ""},
+		{"verify", fmt.Sprintf("%s verify\n", host), tlsSkip, roots, http.StatusOK, ""},
+		{"verify unknown authority", fmt.Sprintf("%s verify\n", host), tlsSkip, nil, http.StatusBadGateway, fmt.Sprintf("could not verify the certificate of %s", host)},
+		{"default verify", "", tlsVerify, nil, http.StatusBadGateway, fmt.Sprintf("could not verify the certificate of %s", host)},
+		{"pin", fmt.Sprintf("*.%s pin %s,%s\n", testOnionID, testPin(other), testPin(leaf)), tlsSkip, nil, http.StatusOK, ""},
+		{"pin mismatch", fmt.Sprintf("*.%s pin %s\n", testOnionID, testPin(other)), tlsSkip, nil, http.StatusBadGateway, (&tlsPinError{Host: host, Got: []string{testPin(leaf)}}).Error()},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "ok")
+			}))
+			upstream.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+			upstream.StartTLS()
+			defer upstream.Close()
+
+			socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+			app := newTestApplication(t, domain, socks.URL())
+			app.tlsDefault = tt.defaultMode
+			app.tlsRoots = tt.roots
+			if tt.policy != "" {
+				app.tlsPolicyPath = filepath.Join(t.TempDir(), "tls_policy")
+				require.Nil(t, os.WriteFile(app.tlsPolicyPath, []byte(tt.policy), 0o600))
+				require.Nil(t, app.loadTLSPolicies())
+			}
+			app.transport.TLSClientConfig = app.tlsClientConfig()
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = fmt.Sprintf("%s.%s:443", testOnionID, domain)
+			w := httptest.NewRecorder()
+			app.routes().ServeHTTP(w, r)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedError != "" {
+				// html/template escapes the + of the base64 encoded pins
+				assert.Contains(t, html.UnescapeString(w.Body.String()), tt.expectedError)
+				return
+			}
+			assert.Equal(t, "ok", w.Body.String())
+		})
+	}
+}
+
+func TestTLSPinChain(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	host := fmt.Sprintf("%s.onion", testOnionID)
+	issuer, issuerCert := newTestCertificate(t, "issuer.example")
+	attacker, _ := newTestCertificate(t, host)
+	// the certificates are public so anybody can send the pinned issuer
+	spoofed := tls.Certificate{Certificate: [][]byte{attacker.Certificate[0], issuer.Certificate[0]}, PrivateKey: attacker.PrivateKey}
+
+	tests := []struct {
+		name           string
+		cert           tls.Certificate
+		expectedStatus int
+	}{
+		{"signed by pinned issuer", newTestLeafCertificate(t, issuer, host), http.StatusOK},
+		{"appended pinned issuer", spoofed, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "ok")
+			}))
+			upstream.TLS = &tls.Config{Certificates: []tls.Certificate{tt.cert}}
+			upstream.StartTLS()
+			defer upstream.Close()
+
+			socks := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+			app := newTestApplication(t, domain, socks.URL())
+			app.tlsPolicyPath = filepath.Join(t.TempDir(), "tls_policy")
+			require.Nil(t, os.WriteFile(app.tlsPolicyPath, []byte(fmt.Sprintf("%s pin %s\n", host, testPin(issuerCert))), 0o600))
+			require.Nil(t, app.loadTLSPolicies())
+			app.transport.TLSClientConfig = app.tlsClientConfig()
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Host = fmt.Sprintf("%s.%s:443", testOnionID, domain)
+			w := httptest.NewRecorder()
+			app.routes().ServeHTTP(w, r)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// torBackend is a single TOR SOCKS proxy
+type torBackend struct {
+	URL *url.URL
+	// address is the host and port the transport dials
+	address string
+	healthy atomic.Bool
+	// conns is the number of open connections to the backend
+	conns atomic.Int64
+}
+
+// torPool spreads the requests over multiple TOR daemons. Backends failing a
+// health check or a dial are ejected until the next successful health check.
+type torPool struct {
+	backends []*torBackend
+	next     atomic.Uint64
+	// healthTarget is connected to through the backends during a health
+	// check, if empty only the SOCKS handshake is checked
+	healthTarget string
+	timeout      time.Duration
+}
+
+// parseTorBackends parses a comma separated list of proxy urls
+func parseTorBackends(s string) ([]*url.URL, error) {
+	var urls []*url.URL
+	for _, raw := range strings.Split(s, ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %s: %w", raw, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy url %s: needs a scheme and a host", raw)
+		}
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("please provide at least one TOR proxy")
+	}
+	return urls, nil
+}
+
+func newTorPool(urls []*url.URL, healthTarget string, timeout time.Duration) *torPool {
+	p := &torPool{
+		healthTarget: healthTarget,
+		timeout:      timeout,
+	}
+	for _, u := range urls {
+		b := &torBackend{
+			URL:     u,
+			address: proxyAddress(u),
+		}
+		// backends are healthy until proven otherwise
+		b.healthy.Store(true)
+		p.backends = append(p.backends, b)
+	}
+	return p
+}
+
+// proxyAddress returns the address the transport dials for a proxy url
+func proxyAddress(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "1080"
+	switch u.Scheme {
+	case "http":
+		port = "80"
+	case "https":
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// proxy is used as the Proxy function of the transport
+func (p *torPool) proxy(r *http.Request) (*url.URL, error) {
+	return p.pick().URL, nil
+}
+
+// pick returns the healthy backend with the least open connections. Backends
+// with the same load are used in turns. If all backends are unhealthy all of
+// them are tried so a failing health check does not stop all traffic.
+func (p *torPool) pick() *torBackend {
+	candidates := make([]*torBackend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.healthy.Load() {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.backends
+	}
+	start := p.next.Add(1)
+	var best *torBackend
+	for i := range candidates {
+		b := candidates[(start+uint64(i))%uint64(len(candidates))]
+		if best == nil || b.conns.Load() < best.conns.Load() {
+			best = b
+		}
+	}
+	return best
+}
+
+// backend returns the backend listening on address
+func (p *torPool) backend(address string) *torBackend {
+	for _, b := range p.backends {
+		if b.address == address {
+			return b
+		}
+	}
+	return nil
+}
+
+// probe checks if the backend accepts SOCKS connections and can reach the
+// health target
+func (p *torPool) probe(ctx context.Context, b *torBackend) error {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	dialer := &net.Dialer{}
+	if !strings.HasPrefix(b.URL.Scheme, "socks5") {
+		conn, err := dialer.DialContext(ctx, "tcp", b.address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	if p.healthTarget != "" {
+		d, err := proxy.FromURL(b.URL, dialer)
+		if err != nil {
+			return err
+		}
+		conn, err := d.(proxy.ContextDialer).DialContext(ctx, "tcp", p.healthTarget)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", b.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	// version 5 offering no authentication and username/password
+	// https://www.rfc-editor.org/rfc/rfc1928#section-3
+	if _, err := conn.Write([]byte{5, 2, 0, 2}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] == 0xff {
+		return fmt.Errorf("unexpected SOCKS greeting reply %v", reply)
+	}
+	return nil
+}
+
+// torConn tracks the open connections to a backend
+type torConn struct {
+	net.Conn
+	backend *torBackend
+	once    sync.Once
+}
+
+func (c *torConn) Close() error {
+	c.once.Do(func() {
+		c.backend.conns.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// dialTor wraps the DialContext function of the transport. Connections to a
+// backend are counted and the backend is ejected if it can not be reached.
+// Dials canceled by the client say nothing about the backend.
+func (app *application) dialTor(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		b := app.tor.backend(address)
+		if b == nil {
+			return conn, err
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				app.setTorBackendHealth(b, err)
+			}
+			return nil, err
+		}
+		b.conns.Add(1)
+		return &torConn{Conn: conn, backend: b}, nil
+	}
+}
+
+// setTorBackendHealth updates the state of the backend and logs changes
+func (app *application) setTorBackendHealth(b *torBackend, err error) {
+	healthy := err == nil
+	if b.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		app.logger.Infof("TOR backend %s is healthy again", b.address)
+		if app.JsonLoggerEnabled {
+			message := fmt.Sprintf("TOR backend %s is healthy again", b.address)
+			app.JsonLogger.DebugLevel(message)
+		}
+		return
+	}
+	app.logger.Errorf("TOR backend %s is unhealthy: %v", b.address, err)
+	if app.JsonLoggerEnabled {
+		message := fmt.Sprintf("TOR backend %s is unhealthy: %v", b.address, err)
+		app.JsonLogger.ErrorLevel(message)
+	}
+}
+
+// checkTorBackends probes all backends concurrently
+func (app *application) checkTorBackends(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range app.tor.backends {
+		wg.Add(1)
+		go func(b *torBackend) {
+			defer wg.Done()
+			app.setTorBackendHealth(b, app.tor.probe(ctx, b))
+		}(b)
+	}
+	wg.Wait()
+}
+
+// torHealthCheck probes all backends and polls the bootstrap state every
+// interval until ctx is done
+func (app *application) torHealthCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		app.checkTorBackends(ctx)
+		if app.control != nil {
+			app.checkTorBootstrap(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPoolApplication returns an application spreading the requests over
+// all SOCKS servers in socksURLs
+func newTestPoolApplication(t *testing.T, domain string, healthTarget string, socksURLs ...string) *application {
+	t.Helper()
+
+	var urls []*url.URL
+	for _, socksURL := range socksURLs {
+		u, err := url.Parse(socksURL)
+		require.Nil(t, err)
+		urls = append(urls, u)
+	}
+	app := newTestApplication(t, domain, socksURLs[0])
+	app.tor = newTorPool(urls, healthTarget, time.Second)
+	app.transport.Proxy = app.tor.proxy
+	app.transport.DisableKeepAlives = true
+	app.transport.DialContext = app.dialTor((&net.Dialer{}).DialContext)
+	return app
+}
+
+// closedAddress returns an address nobody listens on
+func closedAddress(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	address := listener.Addr().String()
+	require.Nil(t, listener.Close())
+	return address
+}
+
+func TestParseTorBackends(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+		err      string
+	}{
+		{"single", "socks5://127.0.0.1:9050", []string{"127.0.0.1:9050"}, ""},
+		{"multiple", "socks5://tor1:9050, socks5://tor2:9050,", []string{"tor1:9050", "tor2:9050"}, ""},
+		{"empty", " , ", nil, "at least one"},
+		{"no scheme", "127.0.0.1:9050", nil, "invalid proxy url"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			urls, err := parseTorBackends(tt.input)
+			if tt.err != "" {
+				require.NotNil(t, err)
+				assert.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.Nil(t, err)
+			var hosts []string
+			for _, u := range urls {
+				hosts = append(hosts, u.Host)
+			}
+			assert.Equal(t, tt.expected, hosts)
+		})
+	}
+}
+
+func TestProxyAddress(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"socks5://tor:9050", "tor:9050"},
+		{"socks5h://tor", "tor:1080"},
+		{"http://proxy", "proxy:80"},
+		{"https://proxy", "proxy:443"},
+	}
+	for _, tt := range tests {
+		tt := tt // NOTE: https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+		t.Run(tt.input, func(t *testing.T) {
+			t.Parallel()
+
+			u, err := url.Parse(tt.input)
+			require.Nil(t, err)
+			assert.Equal(t, tt.expected, proxyAddress(u))
+		})
+	}
+}
+
+func TestTorPoolPick(t *testing.T) {
+	t.Parallel()
+
+	urls, err := parseTorBackends("socks5://tor1:9050,socks5://tor2:9050,socks5://tor3:9050")
+	require.Nil(t, err)
+	p := newTorPool(urls, "", time.Second)
+
+	// equal load is spread in turns
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		seen[p.pick().address]++
+	}
+	assert.Equal(t, map[string]int{"tor1:9050": 2, "tor2:9050": 2, "tor3:9050": 2}, seen)
+
+	// the least loaded backend wins
+	p.backends[0].conns.Store(2)
+	p.backends[1].conns.Store(1)
+	p.backends[2].conns.Store(3)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "tor2:9050", p.pick().address)
+	}
+
+	// unhealthy backends are skipped
+	p.backends[1].healthy.Store(false)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "tor1:9050", p.pick().address)
+	}
+
+	// without a healthy backend all of them are tried
+	for _, b := range p.backends {
+		b.healthy.Store(false)
+	}
+	assert.Equal(t, "tor2:9050", p.pick().address)
+}
+
+func TestTorPoolRequests(t *testing.T) {
+	t.Parallel()
+
+	const domain = "onion.zwiebel"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer upstream.Close()
+
+	var servers []*fakeSOCKSServer
+	var socksURLs []string
+	for i := 0; i < 3; i++ {
+		s := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+		servers = append(servers, s)
+		socksURLs = append(socksURLs, s.URL())
+	}
+	dead := fmt.Sprintf("socks5://%s", closedAddress(t))
+	app := newTestPoolApplication(t, domain, "", append(socksURLs, dead)...)
+
+	request := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = fmt.Sprintf("%s.%s", testOnionID, domain)
+		w := httptest.NewRecorder()
+		app.routes().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// the dead backend is ejected after the first failed dial
+	failed := 0
+	for i := 0; i < 12; i++ {
+		if request() != http.StatusOK {
+			failed++
+		}
+	}
+	assert.LessOrEqual(t, failed, 1)
+	assert.False(t, app.tor.backends[3].healthy.Load())
+	for _, s := range servers {
+		assert.NotEmpty(t, s.Requests())
+	}
+}
+
+func TestTorHealthCheck(t *testing.T) {
+	t.Parallel()
+
+	healthy := newFakeSOCKSServer(t, closedAddress(t))
+	dead := fmt.Sprintf("socks5://%s", closedAddress(t))
+
+	t.Run("handshake", func(t *testing.T) {
+		t.Parallel()
+
+		app := newTestPoolApplication(t, "onion.zwiebel", "", healthy.URL(), dead)
+		app.checkTorBackends(context.Background())
+		assert.True(t, app.tor.backends[0].healthy.Load())
+		assert.False(t, app.tor.backends[1].healthy.Load())
+	})
+
+	t.Run("health target", func(t *testing.T) {
+		t.Parallel()
+
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer upstream.Close()
+		target := newFakeSOCKSServer(t, upstream.Listener.Addr().String())
+		failing := newFakeSOCKSServer(t, closedAddress(t))
+
+		app := newTestPoolApplication(t, "onion.zwiebel", "duckduckgo.onion:80", target.URL(), failing.URL())
+		// general SOCKS server failure, like a TOR daemon still bootstrapping
+		failing.setReply(1)
+		app.checkTorBackends(context.Background())
+		assert.True(t, app.tor.backends[0].healthy.Load())
+		assert.False(t, app.tor.backends[1].healthy.Load())
+		require.NotEmpty(t, target.Requests())
+		assert.Equal(t, "duckduckgo.onion", target.Requests()[0].Host)
+
+		// readmitted once the health check succeeds again
+		failing.target = upstream.Listener.Addr().String()
+		failing.setReply(0)
+		app.checkTorBackends(context.Background())
+		assert.True(t, app.tor.backends[1].healthy.Load())
+	})
+}
+
+func TestDialTorCanceled(t *testing.T) {
+	t.Parallel()
+
+	healthy := newFakeSOCKSServer(t, closedAddress(t))
+	app := newTestPoolApplication(t, "onion.zwiebel", "", healthy.URL())
+	address := app.tor.backends[0].address
+	dial := app.dialTor(func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	// a client disconnecting during the dial does not eject the backend
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := dial(ctx, "tcp", address)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.True(t, app.tor.backends[0].healthy.Load())
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = dial(ctx, "tcp", address)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.True(t, app.tor.backends[0].healthy.Load())
+}